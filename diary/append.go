@@ -3,10 +3,7 @@ package diary
 import (
 	"appengine"
 	"appengine/datastore"
-	"bytes"
-	"fmt"
 	"net/http"
-	"strings"
 	"time"
 )
 
@@ -28,20 +25,17 @@ func appendToEntry(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var doc bytes.Buffer
-
-	entryAppendTemplate.Execute(&doc, EntryContent{
-		Date:    e.Date,
-		Content: strings.Replace(string(e.Content), "\n", "<br>\n\n", -1),
-		Key:     rawKey,
-	})
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	baseTemplate.Execute(w, BodyContent{
-		Body:  doc.String(),
-		Title: e.Date.Format("Monday, 2. Jan"),
+	renderPage(c, w, entryAppendTemplate, e.Date.In(loc).Format("Monday, 2. Jan"), EntryContent{
+		Date:     e.Date.In(loc),
+		Sections: newSectionContents(e, loc),
+		Key:      rawKey,
 	})
-
 }
 
 func appendToEntrySubmit(w http.ResponseWriter, r *http.Request) {
@@ -63,20 +57,14 @@ func appendToEntrySubmit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var e DiaryEntry
-	err = datastore.Get(c, key, &e)
-	if err != nil {
-		c.Errorf("failed to fetch entry: %v", err)
-		return
-	}
-
-	newContent := fmt.Sprintf("%v\n\n\n\n<b>extended on %v</b>\n\n%v",
-		string(e.Content),
-		time.Now().Format("Monday, 2. Jan - 15:04"),
-		content)
-
-	e.Content = []byte(newContent)
-
-	_, err = datastore.Put(c, key, &e)
+	_, err = saveEntry(c, key, &e, sourceWeb, func(e *DiaryEntry) error {
+		e.Sections = append(entrySections(*e), Section{
+			Text:         []byte(content),
+			Source:       sourceWeb,
+			CreationTime: time.Now(),
+		})
+		return nil
+	})
 
 	if err != nil {
 		c.Errorf("failed to save entry: %v", err)
@@ -0,0 +1,188 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"fmt"
+	"net/http"
+)
+
+// attachmentCache loads the attachments of many entries with a single
+// GetMulti and keeps them around for the rest of the request, so rendering
+// a page doesn't cost one datastore round trip per attachment.
+type attachmentCache struct {
+	c           appengine.Context
+	store       attachmentStore
+	attachments map[string]*Attachment
+}
+
+func newAttachmentCache(c appengine.Context) *attachmentCache {
+	return &attachmentCache{
+		c:           c,
+		store:       datastoreAttachments{c},
+		attachments: map[string]*Attachment{},
+	}
+}
+
+// attachmentStore fetches attachments by key. It's the datastore, except in
+// the benchmarks.
+type attachmentStore interface {
+	GetMulti(keys []*datastore.Key, dst []Attachment) error
+}
+
+type datastoreAttachments struct {
+	c appengine.Context
+}
+
+func (s datastoreAttachments) GetMulti(keys []*datastore.Key, dst []Attachment) error {
+	return datastore.GetMulti(s.c, keys, dst)
+}
+
+// Prefetch loads all attachments of the given entries that aren't cached yet.
+// Attachments which can't be loaded are logged and left out.
+func (ac *attachmentCache) Prefetch(entries []DiaryEntry) error {
+	keys := []*datastore.Key{}
+	for _, e := range entries {
+		for _, key := range e.Attachments {
+			if _, ok := ac.attachments[key.Encode()]; !ok {
+				keys = append(keys, key)
+				// also dedups keys within this batch
+				ac.attachments[key.Encode()] = nil
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	attachments := make([]Attachment, len(keys))
+	err := ac.store.GetMulti(keys, attachments)
+	errs, partial := err.(appengine.MultiError)
+	if err != nil && !partial {
+		return fmt.Errorf("failed to fetch attachments: %v", err)
+	}
+
+	for i, key := range keys {
+		if partial && errs[i] != nil {
+			ac.c.Errorf("failed to fetch attachment for key '%v': %v", key, errs[i])
+			continue
+		}
+		ac.attachments[key.Encode()] = &attachments[i]
+	}
+	return nil
+}
+
+// Get returns a prefetched attachment, or nil if it couldn't be loaded.
+func (ac *attachmentCache) Get(key *datastore.Key) *Attachment {
+	return ac.attachments[key.Encode()]
+}
+
+// List returns the loaded attachments of an entry, in order.
+func (ac *attachmentCache) List(e DiaryEntry) []*Attachment {
+	attachments := []*Attachment{}
+	for _, key := range e.Attachments {
+		if a := ac.Get(key); a != nil {
+			attachments = append(attachments, a)
+		}
+	}
+	return attachments
+}
+
+// linkAttachmentsLater points the attachments of an entry back to it. They
+// are created before their entry and are in entity groups of their own, so
+// this happens in a task after the entry is saved, which also catches moves
+// and merges.
+var linkAttachmentsLater = delay.Func("linkAttachments", linkAttachments)
+
+func linkAttachments(c appengine.Context, entryKey *datastore.Key) error {
+	_, err := linkEntryAttachments(c, entryKey)
+	return err
+}
+
+// linkEntryAttachments returns the number of attachments that had to be
+// updated.
+func linkEntryAttachments(c appengine.Context, entryKey *datastore.Key) (int, error) {
+	var e DiaryEntry
+	err := datastore.Get(c, entryKey, &e)
+	if err == datastore.ErrNoSuchEntity {
+		// trashed entries keep their attachments, and the links, for a restore
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to fetch entry: %v", err)
+	}
+	if len(e.Attachments) == 0 {
+		return 0, nil
+	}
+
+	attachments := make([]Attachment, len(e.Attachments))
+	err = datastore.GetMulti(c, e.Attachments, attachments)
+	errs, partial := err.(appengine.MultiError)
+	if err != nil && !partial {
+		return 0, fmt.Errorf("failed to fetch attachments: %v", err)
+	}
+
+	keys := []*datastore.Key{}
+	changed := []Attachment{}
+	for i, a := range attachments {
+		if partial && errs[i] != nil {
+			c.Errorf("failed to fetch attachment for key '%v': %v", e.Attachments[i], errs[i])
+			continue
+		}
+		if a.Entry != nil && a.Entry.Equal(entryKey) && a.Date.Equal(e.Date) {
+			continue
+		}
+		a.Entry = entryKey
+		a.Date = e.Date
+		keys = append(keys, e.Attachments[i])
+		changed = append(changed, a)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if _, err = datastore.PutMulti(c, keys, changed); err != nil {
+		return 0, fmt.Errorf("failed to save attachments: %v", err)
+	}
+	return len(keys), nil
+}
+
+// linkAllAttachments is the one-off migration filling in Entry and Date of
+// attachments saved before they had them.
+func linkAllAttachments(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	linkAllAttachmentsLater.Call(c, "")
+	fmt.Fprint(w, "Linking attachments in the background")
+}
+
+// linkAllAttachmentsLater calls itself with the next cursor, so it's set in init
+var linkAllAttachmentsLater *delay.Function
+
+func init() {
+	linkAllAttachmentsLater = delay.Func("linkAllAttachments", linkAttachmentBatch)
+}
+
+func linkAttachmentBatch(c appengine.Context, cursor string) error {
+	linked := 0
+	next, err := migrateEntries(c, cursor, func(key *datastore.Key, e *DiaryEntry) error {
+		if len(e.Attachments) == 0 {
+			return nil
+		}
+		n, err := linkEntryAttachments(c, key)
+		linked += n
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.Infof("Linked %v attachments", linked)
+
+	if next != "" {
+		linkAllAttachmentsLater.Call(c, next)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// memoryAttachments is an in-memory attachment store. Every call waits for
+// roundTrip, standing in for the latency of a datastore RPC.
+type memoryAttachments struct {
+	attachments map[string]Attachment
+	roundTrip   time.Duration
+}
+
+func (m *memoryAttachments) GetMulti(keys []*datastore.Key, dst []Attachment) error {
+	time.Sleep(m.roundTrip)
+	errs := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		a, ok := m.attachments[key.Encode()]
+		if !ok {
+			errs[i] = datastore.ErrNoSuchEntity
+			failed = true
+			continue
+		}
+		dst[i] = a
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+const (
+	benchmarkAttachmentsPerEntry = 3
+	benchmarkRoundTrip           = time.Millisecond
+)
+
+// newBenchmarkPage returns a page of entries with their attachments in an
+// in-memory store. The context is only needed to build keys.
+func newBenchmarkPage(b *testing.B) (aetest.Context, *memoryAttachments, []DiaryEntry) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	store := &memoryAttachments{
+		attachments: map[string]Attachment{},
+		roundTrip:   benchmarkRoundTrip,
+	}
+	entries := []DiaryEntry{}
+	id := int64(0)
+	for i := 0; i < entriesPerPage; i++ {
+		e := DiaryEntry{}
+		for j := 0; j < benchmarkAttachmentsPerEntry; j++ {
+			id++
+			key := datastore.NewKey(c, "Attachment", "", id, nil)
+			store.attachments[key.Encode()] = Attachment{Name: fmt.Sprintf("%v.jpg", id)}
+			e.Attachments = append(e.Attachments, key)
+		}
+		entries = append(entries, e)
+	}
+	return c, store, entries
+}
+
+// BenchmarkPrefetch loads the attachments of a page with one GetMulti, like
+// the pages do.
+func BenchmarkPrefetch(b *testing.B) {
+	c, store, entries := newBenchmarkPage(b)
+	defer c.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ac := &attachmentCache{c: c, store: store, attachments: map[string]*Attachment{}}
+		if err := ac.Prefetch(entries); err != nil {
+			b.Fatal(err)
+		}
+		for _, e := range entries {
+			if len(ac.List(e)) != benchmarkAttachmentsPerEntry {
+				b.Fatal("attachments missing")
+			}
+		}
+	}
+}
+
+// BenchmarkGetEach loads the same attachments with one Get each, like the
+// pages did before the cache.
+func BenchmarkGetEach(b *testing.B) {
+	c, store, entries := newBenchmarkPage(b)
+	defer c.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, e := range entries {
+			for _, key := range e.Attachments {
+				a := make([]Attachment, 1)
+				if err := store.GetMulti([]*datastore.Key{key}, a); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// number of entries shown per page on the home page
+const entriesPerPage = 20
+
+// timezone all entry dates are interpreted in
+const diaryTimezone = "Europe/Vienna"
+
+// the diary has a single author, who gets the reminders
+const diaryAuthor = "Julian"
+
+const dateFormat = "2006-01-02"
+
+// EntryFilter holds the query parameters understood by the entries page.
+type EntryFilter struct {
+	Prompt string
+	// From and To are inclusive days, zero if not set
+	From   time.Time
+	To     time.Time
+	Cursor string
+}
+
+func parseEntryFilter(args url.Values, loc *time.Location) (EntryFilter, error) {
+	f := EntryFilter{
+		Prompt: args.Get("prompt"),
+		Cursor: args.Get("cursor"),
+	}
+
+	var err error
+	if raw := args.Get("from"); raw != "" {
+		if f.From, err = time.ParseInLocation(dateFormat, raw, loc); err != nil {
+			return f, fmt.Errorf("invalid from date '%v': %v", raw, err)
+		}
+	}
+	if raw := args.Get("to"); raw != "" {
+		if f.To, err = time.ParseInLocation(dateFormat, raw, loc); err != nil {
+			return f, fmt.Errorf("invalid to date '%v': %v", raw, err)
+		}
+	}
+	return f, nil
+}
+
+// Query builds the datastore query for one page of entries, newest first.
+func (f EntryFilter) Query() (*datastore.Query, error) {
+	q := datastore.NewQuery("DiaryEntry").Order("-Date")
+
+	if f.Prompt != "" {
+		q = q.Filter("Prompt =", f.Prompt)
+	}
+	if !f.From.IsZero() {
+		q = q.Filter("Date >=", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Filter("Date <", f.To.AddDate(0, 0, 1))
+	}
+	if f.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(f.Cursor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor: %v", err)
+		}
+		q = q.Start(cursor)
+	}
+
+	// one more than we show, to know whether there is a next page
+	return q.Limit(entriesPerPage + 1), nil
+}
+
+// URL returns a link to the entries page with this filter applied.
+func (f EntryFilter) URL() string {
+	args := url.Values{}
+	if f.Prompt != "" {
+		args.Set("prompt", f.Prompt)
+	}
+	if !f.From.IsZero() {
+		args.Set("from", f.From.Format(dateFormat))
+	}
+	if !f.To.IsZero() {
+		args.Set("to", f.To.Format(dateFormat))
+	}
+	if f.Cursor != "" {
+		args.Set("cursor", f.Cursor)
+	}
+	if len(args) == 0 {
+		return "/"
+	}
+	return "/?" + args.Encode()
+}
+
+// buildNavigation collects the links for jumping to a year or a month of the
+// selected year, as well as to the next page of the current listing.
+func buildNavigation(c appengine.Context, f EntryFilter, next string, loc *time.Location) (NavigationContent, error) {
+	now := time.Now().In(loc)
+	nav := NavigationContent{
+		From: formatDate(f.From),
+		To:   formatDate(f.To),
+	}
+
+	if next != "" {
+		older := f
+		older.Cursor = next
+		nav.Older = older.URL()
+	}
+	if f.Cursor != "" {
+		newest := f
+		newest.Cursor = ""
+		nav.Newest = newest.URL()
+	}
+
+	// the oldest entry determines how far back the year links go
+	var oldest []DiaryEntry
+	_, err := datastore.NewQuery("DiaryEntry").Order("Date").Project("Date").Limit(1).GetAll(c, &oldest)
+	if err != nil {
+		return nav, fmt.Errorf("failed to fetch oldest entry: %v", err)
+	}
+	firstYear := now.Year()
+	if len(oldest) > 0 {
+		firstYear = oldest[0].Date.In(loc).Year()
+	}
+
+	selected := now.Year()
+	if !f.From.IsZero() {
+		selected = f.From.Year()
+	}
+
+	for year := now.Year(); year >= firstYear; year-- {
+		start := time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+		nav.Years = append(nav.Years, NavigationLink{
+			Label:  fmt.Sprint(year),
+			URL:    EntryFilter{Prompt: f.Prompt, From: start, To: start.AddDate(1, 0, -1)}.URL(),
+			Active: year == selected,
+		})
+	}
+
+	for month := time.January; month <= time.December; month++ {
+		start := time.Date(selected, month, 1, 0, 0, 0, 0, loc)
+		if start.After(now) {
+			break
+		}
+		end := start.AddDate(0, 1, -1)
+		nav.Months = append(nav.Months, NavigationLink{
+			Label:  month.String()[:3],
+			URL:    EntryFilter{Prompt: f.Prompt, From: start, To: end}.URL(),
+			Active: f.From.Equal(start) && f.To.Equal(end),
+		})
+	}
+
+	return nav, nil
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(dateFormat)
+}
@@ -0,0 +1,93 @@
+package diary
+
+import (
+	"appengine"
+	"net/http"
+	"time"
+)
+
+// showCalendar shows a month as a grid of weeks starting on Monday, the
+// current month unless ?month=2013-05 is given.
+func showCalendar(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	today := startOfDay(time.Now().In(loc))
+	start := today.AddDate(0, 0, 1-today.Day())
+	if raw := r.FormValue("month"); raw != "" {
+		month, err := time.ParseInLocation("2006-01", raw, loc)
+		if err != nil {
+			http.Error(w, "invalid month, expected YYYY-MM", http.StatusBadRequest)
+			return
+		}
+		start = month
+	}
+	end := start.AddDate(0, 1, 0)
+
+	var entries []DiaryEntry
+	_, err = entriesBetween(start, end).GetAll(c, &entries)
+	if err != nil {
+		c.Errorf("failed to fetch entries: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	days := map[string]*CalendarDayContent{}
+	for _, e := range entries {
+		date := e.Date.In(loc).Format(dateFormat)
+		d, ok := days[date]
+		if !ok {
+			d = &CalendarDayContent{}
+			days[date] = d
+		}
+		d.Entries++
+		d.Attachments += len(e.Attachments)
+		// of several entries on a day, the one with a score wins
+		if e.Mood > 0 {
+			d.Mood = e.Mood
+		}
+	}
+
+	content := CalendarContent{
+		Month:    start,
+		Previous: start.AddDate(0, -1, 0).Format("2006-01"),
+		Weeks:    [][]CalendarDayContent{},
+	}
+	if end.Before(today.AddDate(0, 0, 1)) {
+		content.Next = end.Format("2006-01")
+	}
+
+	// weeks start on Monday, like on the fields page
+	day := start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+	for day.Before(end) {
+		week := []CalendarDayContent{}
+		for i := 0; i < 7; i++ {
+			d := CalendarDayContent{}
+			if found, ok := days[day.Format(dateFormat)]; ok {
+				d = *found
+			}
+			d.Date = day
+			d.Day = day.Format(dateFormat)
+			d.InMonth = !day.Before(start) && day.Before(end)
+			d.Missing = d.InMonth && d.Entries == 0 && !day.After(today)
+			d.Today = day.Equal(today)
+			if d.Missing {
+				content.Missing++
+			}
+			week = append(week, d)
+			day = day.AddDate(0, 0, 1)
+		}
+		content.Weeks = append(content.Weeks, week)
+	}
+
+	renderPage(c, w, calendarTemplate, start.Format("January 2006"), content)
+}
@@ -5,11 +5,9 @@ import (
 	"appengine/blobstore"
 	"appengine/datastore"
 	"appengine/user"
-	"bytes"
-	"fmt"
 	"net/http"
-	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type Attachment struct {
@@ -19,31 +17,145 @@ type Attachment struct {
 	BigImage     string
 	ContentType  string
 	CreationTime time.Time
+	// the entry the attachment belongs to and its date, kept up to date by
+	// linkAttachments
+	Entry *datastore.Key
+	Date  time.Time
 }
 
 type DiaryEntry struct {
-	Author       string
+	Author string
+	// plain text of all sections, see joinSections
 	Content      []byte
 	Date         time.Time
 	CreationTime time.Time
 	Attachments  []*datastore.Key
+	// the writing prompt of the reminder this entry replied to, if any
+	Prompt   string
+	Sections []Section
+	// found by the extractors, see extractTags
+	Tags []string
+	// mentioned by name or alias, see findPeople
+	People []string
+	// scores from 1 to 10, 0 if not given, see parseScores
+	Mood   int
+	Energy int
+	// values of the defined fields, see parseFields
+	Fields []FieldValue
+}
+
+// the longest string the datastore indexes, in bytes
+const maxIndexedBytes = 1500
+
+// truncateIndexed cuts s to the length of an indexed string, at the start of
+// a rune.
+func truncateIndexed(s string) string {
+	if len(s) <= maxIndexedBytes {
+		return s
+	}
+	i := maxIndexedBytes
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return s[:i]
 }
 
 func init() {
 	http.HandleFunc("/", showEntries)
 	http.HandleFunc("/tasks/reminder", checkReminder)
+	http.HandleFunc("/tasks/digest", sendDigest)
 	http.HandleFunc("/attachment", showAttachment)
 
 	// handler for postmaster
 	http.HandleFunc("/incoming_mail", incomingMail)
 
+	// permalinks, by date or key
+	http.HandleFunc("/entry/", showEntry)
+
+	// writing entries on the web
+	http.HandleFunc("/new", newEntry)
+	http.HandleFunc("/new_submit", newEntrySubmit)
+	http.HandleFunc("/drafts/save", saveDraft)
+
+	// full-text search
+	http.HandleFunc("/search", showSearch)
+	http.HandleFunc("/api/search", searchAPI)
+
+	// month calendar
+	http.HandleFunc("/calendar", showCalendar)
+
+	// attachment gallery
+	http.HandleFunc("/attachments", showGallery)
+
 	// append to existing entries
 	http.HandleFunc("/append", appendToEntry)
 	http.HandleFunc("/append_submit", appendToEntrySubmit)
 
+	// reminder mail templates
+	http.HandleFunc("/settings/reminder", showReminderSettings)
+	http.HandleFunc("/settings/reminder_submit", saveReminderSettings)
+
+	// writing prompts
+	http.HandleFunc("/prompts", showPrompts)
+	http.HandleFunc("/prompts/add", addPrompt)
+	http.HandleFunc("/prompts/delete", deletePrompt)
+	http.HandleFunc("/prompts/settings", savePromptSettings)
+
+	// editing and revision history
+	http.HandleFunc("/edit", editEntry)
+	http.HandleFunc("/edit_submit", editEntrySubmit)
+	http.HandleFunc("/history", showHistory)
+	http.HandleFunc("/restore", restoreRevision)
+	http.HandleFunc("/move", moveEntry)
+	http.HandleFunc("/move_submit", moveEntrySubmit)
+
+	// trash
+	http.HandleFunc("/delete", deleteEntry)
+	http.HandleFunc("/attachments/delete", deleteAttachment)
+	http.HandleFunc("/trash", showTrash)
+	http.HandleFunc("/trash/restore", trashAction(restoreFromTrash))
+	http.HandleFunc("/trash/purge", trashAction(purgeFromTrash))
+	http.HandleFunc("/trash/empty", emptyTrash)
+
+	// one-off data migrations
+	http.HandleFunc("/tasks/migrate_sections", migrateSections)
+	http.HandleFunc("/tasks/reindex_entries", reindexEntries)
+	http.HandleFunc("/tasks/link_attachments", linkAllAttachments)
+	http.HandleFunc("/tasks/recount_streak", recountStreak)
+
 	// list tags
+	http.HandleFunc("/tags", showTags)
+	http.HandleFunc("/tags/", showTag)
+	http.HandleFunc("/tags/extractors/add", addExtractor)
+	http.HandleFunc("/tags/extractors/delete", deleteExtractor)
 	http.HandleFunc("/show/ideas", showIdeas)
 
+	// idea tracker
+	http.HandleFunc("/ideas", showIdeaBoard)
+	http.HandleFunc("/ideas/", showIdea)
+	http.HandleFunc("/ideas/update", updateIdea)
+
+	// people index
+	http.HandleFunc("/people", showPeople)
+	http.HandleFunc("/people/", showPerson)
+	http.HandleFunc("/people/aliases", saveAliases)
+
+	// mood and energy chart
+	http.HandleFunc("/mood", showMood)
+
+	// custom fields and their stats
+	http.HandleFunc("/fields", showFields)
+	http.HandleFunc("/fields/add", addField)
+	http.HandleFunc("/fields/delete", deleteField)
+
+	// writing statistics
+	http.HandleFunc("/stats", showStats)
+	http.HandleFunc("/api/stats", statsAPI)
+
+	// todos from checkbox items
+	http.HandleFunc("/todos", showTodos)
+	http.HandleFunc("/todos/toggle", toggleTodo)
+
 	// exposed for testing
 	http.HandleFunc("/add_test_data", addTestData)
 	http.HandleFunc("/_ah/mail/", parseMail)
@@ -52,23 +164,44 @@ func init() {
 func showEntries(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
-	u := user.Current(c)
-	if u == nil || !user.IsAdmin(c) {
-		url, err := user.LoginURL(c, r.URL.String())
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Location", url)
-		w.WriteHeader(http.StatusFound)
+	if !ensureAdmin(c, w, r) {
 		return
 	}
 
-	var doc bytes.Buffer
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
 
-	q := datastore.NewQuery("DiaryEntry").Order("-Date")
+	filter, err := parseEntryFilter(r.URL.Query(), loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q, err := filter.Query()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries := []DiaryEntry{}
+	keys := []*datastore.Key{}
+	next := ""
+	t := q.Run(c)
+	for count := 0; ; count++ {
+		if count == entriesPerPage {
+			// the query fetches one extra entry, if it exists there's a next page
+			cursor, err := t.Cursor()
+			if err != nil {
+				c.Errorf("failed to get cursor: %v", err)
+			} else if _, err = t.Next(&DiaryEntry{}); err == nil {
+				next = cursor.String()
+			}
+			break
+		}
 
-	for t := q.Run(c); ; {
 		var e DiaryEntry
 		key, err := t.Next(&e)
 		if err == datastore.Done {
@@ -78,45 +211,96 @@ func showEntries(w http.ResponseWriter, r *http.Request) {
 			c.Errorf("failed to iterate over entries: %v", err)
 			return
 		}
+		entries = append(entries, e)
+		keys = append(keys, key)
+	}
 
-		var attachments bytes.Buffer
-
-		for _, attachmentKey := range e.Attachments {
-
-			if key != nil {
-				var a Attachment
-				err = datastore.Get(c, attachmentKey, &a)
-				if err != nil {
-					c.Errorf("failed to fetch entry for key '%v': %v", attachmentKey, err)
-				} else {
-					attachmentTemplate.Execute(&attachments, AttachmentContent{
-						Name:      a.Name,
-						Thumbnail: a.Thumbnail,
-						Key:       string(a.Content),
-					})
-				}
-			}
+	attachments := newAttachmentCache(c)
+	if err = attachments.Prefetch(entries); err != nil {
+		c.Errorf("%v", err)
+	}
+
+	content := EntriesContent{
+		Prompt:  filter.Prompt,
+		Entries: []EntryContent{},
+	}
+	for i, e := range entries {
+		content.Entries = append(content.Entries, newEntryContent(keys[i], e, attachments, loc))
+	}
+
+	content.Navigation, err = buildNavigation(c, filter, next, loc)
+	if err != nil {
+		c.Errorf("%v", err)
+	}
+
+	renderPage(c, w, entriesTemplate, "Home", content)
+}
+
+// newEntryContent prepares an entry for rendering. Its attachments have to be
+// prefetched into the cache already.
+func newEntryContent(key *datastore.Key, e DiaryEntry, attachments *attachmentCache, loc *time.Location) EntryContent {
+	content := EntryContent{
+		Date:         e.Date.In(loc),
+		Day:          e.Date.In(loc).Format(dateFormat),
+		CreationTime: e.CreationTime.In(loc),
+		Sections:     newSectionContents(e, loc),
+		Key:          key.Encode(),
+		Attachments:  []AttachmentContent{},
+		Prompt:       e.Prompt,
+		Tags:         e.Tags,
+		Mood:         e.Mood,
+		Energy:       e.Energy,
+		Fields:       e.Fields,
+	}
+	for _, attachmentKey := range e.Attachments {
+		a := attachments.Get(attachmentKey)
+		if a == nil {
+			continue
 		}
+		content.Attachments = append(content.Attachments, AttachmentContent{
+			ID:        attachmentKey.Encode(),
+			Name:      a.Name,
+			Thumbnail: a.Thumbnail,
+			BigImage:  a.BigImage,
+			Key:       string(a.Content),
+		})
+	}
+	return content
+}
 
-		entryTemplate.Execute(&doc, EntryContent{
-			Date:         e.Date,
-			CreationTime: e.CreationTime,
-			Content:      strings.Replace(string(e.Content), "\n", "<br>\n\n", -1),
-			Key:          key.Encode(),
-			Attachments:  attachments.String(),
+func newSectionContents(e DiaryEntry, loc *time.Location) []SectionContent {
+	sections := []SectionContent{}
+	for _, s := range entrySections(e) {
+		sections = append(sections, SectionContent{
+			Content:      parseMarkdown(string(s.Text)),
+			Source:       s.Source,
+			CreationTime: s.CreationTime.In(loc),
 		})
 	}
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	baseTemplate.Execute(w, BodyContent{
-		Body:  doc.String(),
-		Title: "Home",
-	})
+	return sections
+}
+
+// ensureAdmin redirects to the login page unless an admin is logged in.
+// Handlers should return immediately if it reports false.
+func ensureAdmin(c appengine.Context, w http.ResponseWriter, r *http.Request) bool {
+	u := user.Current(c)
+	if u == nil || !user.IsAdmin(c) {
+		url, err := user.LoginURL(c, r.URL.String())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		w.Header().Set("Location", url)
+		w.WriteHeader(http.StatusFound)
+		return false
+	}
+	return true
 }
 
 func addTestData(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	e := DiaryEntry{
-		Author: "Julian",
+		Author: diaryAuthor,
 		Content: []byte(`Lorem Ipsum is simply dummy text of the printing and typesetting industry.
 
             Lorem Ipsum has been the industry's standard dummy text ever since the 1500s, when an unknown printer took a galley of type and scrambled it to make a type specimen book. It has survived not only five centuries, but also the leap into electronic typesetting, remaining essentially unchanged. It was popularised in the 1960s with the release of Letraset sheets containing Lorem Ipsum passages, and more recently with desktop publishing software like Aldus PageMaker including versions of Lorem Ipsum.`),
@@ -124,16 +308,17 @@ func addTestData(w http.ResponseWriter, r *http.Request) {
 		CreationTime: time.Now(),
 	}
 
-	_, _ = datastore.Put(c, datastore.NewIncompleteKey(c, "DiaryEntry", nil), &e)
+	settings, _ := loadEntrySettings(c)
+	_, _ = putEntry(c, datastore.NewIncompleteKey(c, "DiaryEntry", nil), &e, settings)
 
 	e = DiaryEntry{
-		Author:       "Julian",
+		Author:       diaryAuthor,
 		Content:      []byte("It is a long established fact that a reader will be distracted by the readable content of a page when looking at its layout. The point of using Lorem Ipsum is that it has a more-or-less normal distribution of letters, as opposed to using 'Content here, content here', making it look like readable English. Many desktop publishing packages and web page editors now use Lorem Ipsum as their default model text, and a search for 'lorem ipsum' will uncover many web sites still in their infancy. Various versions have evolved over the years, sometimes by accident, sometimes on purpose (injected humour and the like)."),
 		Date:         time.Now(),
 		CreationTime: time.Now(),
 	}
 
-	_, _ = datastore.Put(c, datastore.NewIncompleteKey(c, "DiaryEntry", nil), &e)
+	_, _ = putEntry(c, datastore.NewIncompleteKey(c, "DiaryEntry", nil), &e, settings)
 
 	w.Header().Set("Status", "302")
 	w.Header().Set("Location", "/")
@@ -144,30 +329,3 @@ func showAttachment(w http.ResponseWriter, r *http.Request) {
 	rawKey := args.Get("key")
 	blobstore.Send(w, appengine.BlobKey(rawKey))
 }
-
-func showIdeas(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	q := datastore.NewQuery("DiaryEntry").Order("-Date")
-
-	for t := q.Run(c); ; {
-		var e DiaryEntry
-		_, err := t.Next(&e)
-		if err == datastore.Done {
-			break
-		}
-		if err != nil {
-			c.Errorf("failed to iterate over entries: %v", err)
-			return
-		}
-
-		lines := bytes.Split(e.Content, []byte{'\n'})
-		for _, line := range lines {
-			if len(line) > 0 && line[0] == '-' && bytes.Contains(line, []byte("idea")) {
-
-				fmt.Fprintf(w, "idea: %v\n", string(line))
-			}
-		}
-
-	}
-}
@@ -0,0 +1,210 @@
+package diary
+
+import (
+	"appengine"
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DigestContent summarises all entries of one digest period.
+type DigestContent struct {
+	Period     string
+	Start      time.Time
+	End        time.Time
+	EntryCount int
+	WordCount  int
+	Streak     int
+	Entries    []DigestEntry
+}
+
+type DigestEntry struct {
+	Date        time.Time
+	URL         string
+	WordCount   int
+	Highlights  []string
+	Attachments []DigestAttachment
+}
+
+type DigestAttachment struct {
+	Name      string
+	Thumbnail string
+}
+
+const digestSubjectTemplateText = `Your {{.Period}}ly diary digest: {{.Start.Format "2. Jan"}} - {{(.End.AddDate 0 0 -1).Format "2. Jan 2006"}}`
+
+const digestTextTemplateText = `
+Your diary from {{.Start.Format "Monday, 2. Jan"}} to {{(.End.AddDate 0 0 -1).Format "Monday, 2. Jan"}}
+
+Entries: {{.EntryCount}}
+Words:   {{.WordCount}}
+Streak:  {{.Streak}} days
+{{range .Entries}}
+{{.Date.Format "Monday, 2. Jan"}} ({{.WordCount}} words{{if .Attachments}}, {{len .Attachments}} attachments{{end}})
+{{range .Highlights}}  > {{.}}
+{{end}}  {{.URL}}
+{{end}}`
+
+const digestHTMLTemplateText = `
+<h2>Your diary from {{.Start.Format "Monday, 2. Jan"}} to {{(.End.AddDate 0 0 -1).Format "Monday, 2. Jan"}}</h2>
+<p>
+  <b>{{.EntryCount}}</b> entries &middot;
+  <b>{{.WordCount}}</b> words &middot;
+  current streak <b>{{.Streak}}</b> days
+</p>
+{{range .Entries}}
+<div style="margin-bottom:20px">
+  <h3><a href="{{.URL}}">{{.Date.Format "Monday, 2. Jan"}}</a></h3>
+  <small>{{.WordCount}} words</small>
+  {{range .Highlights}}<blockquote>{{.}}</blockquote>{{end}}
+  {{range .Attachments}}<img src="{{.Thumbnail}}" alt="{{.Name}}" height="100" style="margin-right:5px">{{end}}
+</div>
+{{end}}
+`
+
+var digestSubjectTemplate = template.Must(template.New("digestSubject").Parse(digestSubjectTemplateText))
+var digestTextTemplate = template.Must(template.New("digestText").Parse(digestTextTemplateText))
+var digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("digestHTML").Parse(digestHTMLTemplateText))
+
+// maximum number of highlighted lines shown per entry
+const digestHighlights = 3
+
+func sendDigest(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	period := r.FormValue("period")
+	start, end, err := digestRange(period, time.Now().In(loc))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	content, err := buildDigest(c, period, start, end)
+	if err != nil {
+		c.Errorf("failed to build digest: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var subject, text, html bytes.Buffer
+	if err = digestSubjectTemplate.Execute(&subject, content); err == nil {
+		if err = digestTextTemplate.Execute(&text, content); err == nil {
+			err = digestHTMLTemplate.Execute(&html, content)
+		}
+	}
+	if err != nil {
+		c.Errorf("failed to render digest: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = sendMail(c, subject.String(), text.String(), html.String()); err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.Infof("%vly digest sent for %v - %v", period, start, end)
+	fmt.Fprintf(w, "Sent %vly digest with %v entries", period, content.EntryCount)
+}
+
+// digestRange returns the period that ended just before now: the last seven
+// days for weekly digests, the previous calendar month for monthly ones.
+func digestRange(period string, now time.Time) (start, end time.Time, err error) {
+	y, m, d := now.Date()
+	switch period {
+	case "week":
+		end = time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+		start = end.AddDate(0, 0, -7)
+	case "month":
+		end = time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+		start = end.AddDate(0, -1, 0)
+	default:
+		return start, end, fmt.Errorf("unknown digest period '%v'", period)
+	}
+	return start, end, nil
+}
+
+func buildDigest(c appengine.Context, period string, start, end time.Time) (DigestContent, error) {
+	content := DigestContent{
+		Period: period,
+		Start:  start,
+		End:    end,
+	}
+
+	var entries []DiaryEntry
+	keys, err := entriesBetween(start, end).Order("Date").GetAll(c, &entries)
+	if err != nil {
+		return content, fmt.Errorf("failed to load entries: %v", err)
+	}
+
+	attachments := newAttachmentCache(c)
+	if err = attachments.Prefetch(entries); err != nil {
+		// missing attachments just don't get a thumbnail
+		c.Errorf("%v", err)
+	}
+
+	for i, e := range entries {
+		words := len(strings.Fields(string(e.Content)))
+		entry := DigestEntry{
+			Date:       e.Date,
+			URL:        absoluteURL(c, "/entry/"+keys[i].Encode()),
+			WordCount:  words,
+			Highlights: highlightedLines(string(e.Content), digestHighlights),
+		}
+		for _, a := range attachments.List(e) {
+			if a.Thumbnail != "" {
+				entry.Attachments = append(entry.Attachments, DigestAttachment{
+					Name:      a.Name,
+					Thumbnail: a.Thumbnail,
+				})
+			}
+		}
+
+		content.EntryCount++
+		content.WordCount += words
+		content.Entries = append(content.Entries, entry)
+	}
+
+	streak, err := loadStreak(c, diaryAuthor)
+	if err != nil {
+		return content, err
+	}
+	content.Streak = streak.At(end)
+
+	return content, nil
+}
+
+// highlightedLines returns the lines marked with a leading "!", or the first
+// line of the entry if none are marked.
+func highlightedLines(content string, max int) []string {
+	highlights := []string{}
+	first := ""
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if first == "" {
+			first = line
+		}
+		if strings.HasPrefix(line, "!") && len(highlights) < max {
+			highlights = append(highlights, strings.TrimSpace(line[1:]))
+		}
+	}
+	if len(highlights) == 0 && first != "" {
+		highlights = append(highlights, first)
+	}
+	return highlights
+}
+
+func absoluteURL(c appengine.Context, path string) string {
+	return "https://" + appengine.DefaultVersionHostname(c) + path
+}
@@ -0,0 +1,244 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// decodeEntryKey parses the key of a DiaryEntry passed as form value "key".
+// It writes an error response and returns nil if that fails.
+func decodeEntryKey(c appengine.Context, w http.ResponseWriter, r *http.Request) *datastore.Key {
+	rawKey := r.FormValue("key")
+	key, err := datastore.DecodeKey(rawKey)
+	if err != nil || key.Kind() != "DiaryEntry" {
+		c.Errorf("Failed to parse decode key '%v': %v", rawKey, err)
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return nil
+	}
+	return key
+}
+
+func editEntry(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	key := decodeEntryKey(c, w, r)
+	if key == nil {
+		return
+	}
+
+	var e DiaryEntry
+	if err := datastore.Get(c, key, &e); err != nil {
+		c.Errorf("failed to fetch entry: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	content := EntryEditContent{
+		Date:     e.Date.In(loc),
+		Key:      key.Encode(),
+		Sections: []SectionEditContent{},
+	}
+	for _, s := range entrySections(e) {
+		content.Sections = append(content.Sections, SectionEditContent{
+			Text:         string(s.Text),
+			Source:       s.Source,
+			CreationTime: s.CreationTime.In(loc),
+		})
+	}
+
+	attachments := newAttachmentCache(c)
+	if err = attachments.Prefetch([]DiaryEntry{e}); err != nil {
+		c.Errorf("%v", err)
+	}
+	content.Attachments = newEntryContent(key, e, attachments, loc).Attachments
+
+	renderPage(c, w, entryEditTemplate, "Edit "+content.Date.Format("Monday, 2. Jan"), content)
+}
+
+// editSections replaces the text of each section of e with the submitted
+// one, dropping the sections left empty.
+func editSections(e DiaryEntry, texts []string) ([]Section, error) {
+	sections := entrySections(e)
+	if len(texts) != len(sections) {
+		return nil, errEntryChanged
+	}
+
+	changed := []Section{}
+	for i, s := range sections {
+		if strings.TrimSpace(texts[i]) == "" {
+			continue
+		}
+		s.Text = []byte(texts[i])
+		changed = append(changed, s)
+	}
+	if len(changed) == 0 {
+		return nil, errors.New("an entry needs at least one section")
+	}
+	return changed, nil
+}
+
+func editEntrySubmit(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	key := decodeEntryKey(c, w, r)
+	if key == nil {
+		return
+	}
+
+	var e DiaryEntry
+	if err := datastore.Get(c, key, &e); err != nil {
+		c.Errorf("failed to fetch entry: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	r.ParseForm()
+	texts := r.Form["section"]
+	changed, err := editSections(e, texts)
+	if err == errEntryChanged {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sections := entrySections(e)
+	if !bytes.Equal(joinSections(changed), joinSections(sections)) || len(changed) != len(sections) {
+		_, err = saveEntry(c, key, &e, sourceWeb, func(e *DiaryEntry) error {
+			// the sections are applied again to the entry as it is now
+			changed, err := editSections(*e, texts)
+			e.Sections = changed
+			return err
+		})
+		if err == errEntryChanged {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			c.Errorf("%v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/entry/"+key.Encode())
+	w.WriteHeader(http.StatusFound)
+}
+
+func showHistory(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	key := decodeEntryKey(c, w, r)
+	if key == nil {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	var e DiaryEntry
+	if err = datastore.Get(c, key, &e); err != nil {
+		c.Errorf("failed to fetch entry: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	keys, revisions, err := loadRevisions(c, key)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	content := HistoryContent{
+		Date:      e.Date.In(loc),
+		Key:       key.Encode(),
+		Revisions: []RevisionContent{},
+	}
+
+	// newest first, each diffed against the one before it
+	previous := []byte{}
+	for i, rev := range revisions {
+		content.Revisions = append([]RevisionContent{{
+			Key:          keys[i].Encode(),
+			Source:       rev.Source,
+			CreationTime: rev.CreationTime.In(loc),
+			Diff:         diffLines(previous, rev.Content),
+			Current:      i == len(revisions)-1,
+		}}, content.Revisions...)
+		previous = rev.Content
+	}
+
+	renderPage(c, w, historyTemplate, "History "+content.Date.Format("Monday, 2. Jan"), content)
+}
+
+func restoreRevision(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	key := decodeEntryKey(c, w, r)
+	if key == nil {
+		return
+	}
+
+	rawRevision := r.FormValue("revision")
+	revisionKey, err := datastore.DecodeKey(rawRevision)
+	if err != nil || revisionKey.Kind() != "Revision" || !revisionKey.Parent().Equal(key) {
+		c.Errorf("Failed to parse decode key '%v': %v", rawRevision, err)
+		http.Error(w, "invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	var rev Revision
+	if err = datastore.Get(c, revisionKey, &rev); err != nil {
+		c.Errorf("failed to fetch revision: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	// restoring is just another change, so it can be undone as well
+	var e DiaryEntry
+	_, err = saveEntry(c, key, &e, sourceWeb, func(e *DiaryEntry) error {
+		e.Content = rev.Content
+		e.Sections = rev.Sections
+		return nil
+	})
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/history?key="+url.QueryEscape(key.Encode()))
+	w.WriteHeader(http.StatusFound)
+}
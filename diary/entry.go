@@ -0,0 +1,164 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// showEntry is the permalink page of a single day, addressed either by date
+// (/entry/2013-05-03) or by the key of one of its entries.
+func showEntry(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/entry/")
+	keys, entries, err := loadEntries(c, id, loc)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	day := startOfDay(entries[0].Date.In(loc))
+	content := EntryPageContent{
+		Date:    day,
+		Entries: []EntryContent{},
+	}
+
+	content.Previous, err = adjacentDay(c, day, -1, loc)
+	if err != nil {
+		c.Errorf("%v", err)
+	}
+	content.Next, err = adjacentDay(c, day, 1, loc)
+	if err != nil {
+		c.Errorf("%v", err)
+	}
+
+	attachments := newAttachmentCache(c)
+	if err = attachments.Prefetch(entries); err != nil {
+		c.Errorf("%v", err)
+	}
+	for i, e := range entries {
+		content.Entries = append(content.Entries, newEntryContent(keys[i], e, attachments, loc))
+	}
+
+	renderPage(c, w, entryPageTemplate, day.Format("Monday, 2. Jan 2006"), content)
+}
+
+// loadEntries returns all entries of the day given as date, or the single
+// entry with the given key.
+func loadEntries(c appengine.Context, id string, loc *time.Location) ([]*datastore.Key, []DiaryEntry, error) {
+	entries := []DiaryEntry{}
+
+	if day, err := time.ParseInLocation(dateFormat, id, loc); err == nil {
+		keys, err := entriesBetween(day, day.AddDate(0, 0, 1)).Order("Date").GetAll(c, &entries)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch entries for %v: %v", id, err)
+		}
+		return keys, entries, nil
+	}
+
+	key, err := datastore.DecodeKey(id)
+	if err != nil || key.Kind() != "DiaryEntry" {
+		// neither a date nor a key, so there is no such entry
+		return nil, entries, nil
+	}
+
+	var e DiaryEntry
+	err = datastore.Get(c, key, &e)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, entries, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch entry: %v", err)
+	}
+	return []*datastore.Key{key}, append(entries, e), nil
+}
+
+// adjacentDay returns the closest day before (direction -1) or after
+// (direction 1) the given day that has an entry, formatted for /entry/ links.
+// It returns "" if there is none.
+func adjacentDay(c appengine.Context, day time.Time, direction int, loc *time.Location) (string, error) {
+	q := datastore.NewQuery("DiaryEntry").Project("Date").Limit(1)
+	if direction < 0 {
+		q = q.Filter("Date <", day).Order("-Date")
+	} else {
+		q = q.Filter("Date >=", day.AddDate(0, 0, 1)).Order("Date")
+	}
+
+	var entries []DiaryEntry
+	if _, err := q.GetAll(c, &entries); err != nil {
+		return "", fmt.Errorf("failed to fetch adjacent entry: %v", err)
+	}
+	if len(entries) == 0 {
+		return "", nil
+	}
+	return entries[0].Date.In(loc).Format(dateFormat), nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// entriesBetween queries the entries from day from up to, but not including,
+// day to. Entries of a day are dated at its midnight or later, so the start
+// has to be inclusive.
+func entriesBetween(from, to time.Time) *datastore.Query {
+	return datastore.NewQuery("DiaryEntry").Filter("Date >=", from).Filter("Date <", to)
+}
+
+// entries a migration task goes through before it hands over to the next one
+const migrationBatchSize = 100
+
+// migrateEntries calls migrate for the next batch of entries after cursor and
+// returns the cursor to continue from, or "" after the last entry. Migrations
+// run it in a chain of tasks, as going through all entries doesn't fit into a
+// single request; a failed task is retried from the same cursor.
+func migrateEntries(c appengine.Context, cursor string, migrate func(*datastore.Key, *DiaryEntry) error) (string, error) {
+	q := datastore.NewQuery("DiaryEntry")
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return "", fmt.Errorf("invalid cursor: %v", err)
+		}
+		q = q.Start(start)
+	}
+
+	t := q.Run(c)
+	for i := 0; i < migrationBatchSize; i++ {
+		var e DiaryEntry
+		key, err := t.Next(&e)
+		if err == datastore.Done {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to iterate over entries: %v", err)
+		}
+		if err = migrate(key, &e); err != nil {
+			return "", fmt.Errorf("failed to migrate entry '%v': %v", key, err)
+		}
+	}
+
+	next, err := t.Cursor()
+	if err != nil {
+		return "", fmt.Errorf("failed to get cursor: %v", err)
+	}
+	return next.String(), nil
+}
@@ -0,0 +1,353 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldSchema defines a daily metric written as a "name: value" line, like
+// "sleep: 7.5h" or "run: yes".
+type FieldSchema struct {
+	Name string
+	Type string
+	// shown after values and allowed after numbers in entries
+	Unit string
+}
+
+const (
+	fieldNumber  = "number"
+	fieldInteger = "integer"
+	fieldBoolean = "yes/no"
+)
+
+var fieldTypes = []string{fieldNumber, fieldInteger, fieldBoolean}
+
+// FieldSchemas are kept in a single entity, loaded once before an entry is
+// saved, see entrySettings.
+type FieldSchemas struct {
+	Fields []FieldSchema
+}
+
+// FieldValue is the value of a field in an entry. Booleans are 1 or 0, Text is
+// the value as written.
+type FieldValue struct {
+	Name  string
+	Value float64
+	Text  string
+}
+
+var (
+	fieldLineRegexp   = regexp.MustCompile(`^\s*(\pL[\pL\pN _-]*?)\s*:\s*(\S.*?)\s*$`)
+	fieldNumberRegexp = regexp.MustCompile(`^([-+]?\d+(?:[.,]\d+)?)\s*(\S*)$`)
+)
+
+var fieldBooleans = map[string]float64{
+	"yes": 1, "y": 1, "true": 1, "ja": 1, "✓": 1, "✔": 1,
+	"no": 0, "n": 0, "false": 0, "nein": 0, "✗": 0,
+}
+
+func fieldSchemasKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "FieldSchemas", "default", 0, nil)
+}
+
+func loadFieldSchemas(c appengine.Context) ([]FieldSchema, error) {
+	var s FieldSchemas
+	err := datastore.Get(c, fieldSchemasKey(c), &s)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("failed to load field schemas: %v", err)
+	}
+	return s.Fields, nil
+}
+
+// parseFields finds the "name: value" lines of defined fields in content.
+// Lines whose value doesn't fit the type are left alone. If a field is given
+// more than once, the last value counts.
+func parseFields(content []byte, schemas []FieldSchema) []FieldValue {
+	byName := map[string]FieldSchema{}
+	for _, s := range schemas {
+		byName[strings.ToLower(s.Name)] = s
+	}
+
+	values := []FieldValue{}
+	index := map[string]int{}
+	for _, line := range strings.Split(string(content), "\n") {
+		m := fieldLineRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		schema, ok := byName[strings.ToLower(m[1])]
+		if !ok {
+			continue
+		}
+		value, ok := parseFieldValue(schema, m[2])
+		if !ok {
+			continue
+		}
+
+		v := FieldValue{Name: schema.Name, Value: value, Text: m[2]}
+		if i, ok := index[schema.Name]; ok {
+			values[i] = v
+		} else {
+			index[schema.Name] = len(values)
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func parseFieldValue(schema FieldSchema, raw string) (float64, bool) {
+	if schema.Type == fieldBoolean {
+		value, ok := fieldBooleans[strings.ToLower(raw)]
+		return value, ok
+	}
+
+	m := fieldNumberRegexp.FindStringSubmatch(raw)
+	if m == nil || (m[2] != "" && !strings.EqualFold(m[2], schema.Unit)) {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64)
+	if err != nil {
+		return 0, false
+	}
+	if schema.Type == fieldInteger && value != float64(int64(value)) {
+		return 0, false
+	}
+	return value, true
+}
+
+// number of weeks or months on the stats page
+const fieldPeriods = 12
+
+// showFields is the stats page, aggregating each field per week or month
+// (?by=month), followed by the schemas.
+func showFields(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	schemas, err := loadFieldSchemas(c)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderFields(c, w, r.FormValue("by") == "month", schemas, "")
+}
+
+func renderFields(c appengine.Context, w http.ResponseWriter, monthly bool, schemas []FieldSchema, errMsg string) {
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	// the period containing t
+	period := func(t time.Time) time.Time {
+		t = startOfDay(t.In(loc))
+		if monthly {
+			return t.AddDate(0, 0, 1-t.Day())
+		}
+		// weeks start on Monday
+		return t.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+	}
+	next := func(t time.Time) time.Time {
+		if monthly {
+			return t.AddDate(0, 1, 0)
+		}
+		return t.AddDate(0, 0, 7)
+	}
+
+	periods := []time.Time{period(time.Now())}
+	for len(periods) < fieldPeriods {
+		p := period(periods[len(periods)-1].AddDate(0, 0, -1))
+		periods = append(periods, p)
+	}
+	start := periods[len(periods)-1]
+
+	var entries []DiaryEntry
+	_, err = datastore.NewQuery("DiaryEntry").Filter("Date >=", start).GetAll(c, &entries)
+	if err != nil {
+		c.Errorf("failed to fetch entries: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// period -> field -> values
+	values := map[time.Time]map[string][]float64{}
+	for _, e := range entries {
+		p := period(e.Date)
+		if values[p] == nil {
+			values[p] = map[string][]float64{}
+		}
+		for _, v := range e.Fields {
+			values[p][v.Name] = append(values[p][v.Name], v.Value)
+		}
+	}
+
+	content := FieldsContent{
+		Monthly: monthly,
+		Fields:  []FieldSchemaContent{},
+		Periods: []FieldPeriodContent{},
+		Types:   fieldTypes,
+		Error:   errMsg,
+	}
+	for _, s := range schemas {
+		content.Fields = append(content.Fields, FieldSchemaContent{Name: s.Name, Type: s.Type, Unit: s.Unit})
+	}
+	for _, p := range periods {
+		row := FieldPeriodContent{
+			Start: p,
+			End:   next(p).AddDate(0, 0, -1),
+			Stats: []FieldStatsContent{},
+		}
+		for _, s := range schemas {
+			row.Stats = append(row.Stats, fieldStats(s, values[p][s.Name]))
+		}
+		content.Periods = append(content.Periods, row)
+	}
+
+	renderPage(c, w, fieldsTemplate, "Fields", content)
+}
+
+// fieldStats sums up the values of a field in one period.
+func fieldStats(s FieldSchema, values []float64) FieldStatsContent {
+	stats := FieldStatsContent{Days: len(values)}
+	if len(values) == 0 {
+		return stats
+	}
+
+	sum, min, max := 0.0, values[0], values[0]
+	for _, v := range values {
+		sum += v
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64) + s.Unit
+	}
+	if s.Type == fieldBoolean {
+		stats.Summary = fmt.Sprintf("%v of %v days", sum, len(values))
+		return stats
+	}
+	stats.Summary = fmt.Sprintf("avg %v%v, total %v", strconv.FormatFloat(sum/float64(len(values)), 'f', 1, 64), s.Unit, format(sum))
+	stats.Range = fmt.Sprintf("%v – %v", format(min), format(max))
+	return stats
+}
+
+func addField(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	schemas, err := loadFieldSchemas(c)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s := FieldSchema{
+		Name: strings.TrimSpace(whitespaceRegexp.ReplaceAllString(r.FormValue("name"), " ")),
+		Type: r.FormValue("type"),
+		Unit: strings.TrimSpace(r.FormValue("unit")),
+	}
+
+	errMsg := ""
+	if m := fieldLineRegexp.FindStringSubmatch(s.Name + ": x"); m == nil || m[1] != s.Name {
+		errMsg = fmt.Sprintf("'%v' can't be used as a field name, it has to start with a letter", s.Name)
+	}
+	valid := false
+	for _, t := range fieldTypes {
+		valid = valid || t == s.Type
+	}
+	if !valid {
+		errMsg = fmt.Sprintf("unknown field type '%v'", s.Type)
+	}
+	if strings.ContainsAny(s.Unit, " \t") {
+		errMsg = "units can't contain spaces"
+	}
+	for _, existing := range schemas {
+		if strings.EqualFold(existing.Name, s.Name) {
+			errMsg = fmt.Sprintf("there already is a field '%v'", existing.Name)
+		}
+	}
+	if errMsg != "" {
+		renderFields(c, w, false, schemas, errMsg)
+		return
+	}
+
+	if err = saveFieldSchemas(c, append(schemas, s)); err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/fields")
+	w.WriteHeader(http.StatusFound)
+}
+
+// deleteField removes a schema. Values already stored on entries stay until
+// they are reindexed, but aren't shown anymore.
+func deleteField(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	schemas, err := loadFieldSchemas(c)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	kept := []FieldSchema{}
+	for _, s := range schemas {
+		if s.Name != r.FormValue("name") {
+			kept = append(kept, s)
+		}
+	}
+
+	if err = saveFieldSchemas(c, kept); err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/fields")
+	w.WriteHeader(http.StatusFound)
+}
+
+func saveFieldSchemas(c appengine.Context, schemas []FieldSchema) error {
+	sort.Sort(fieldSchemasByName(schemas))
+	s := FieldSchemas{Fields: schemas}
+	if _, err := datastore.Put(c, fieldSchemasKey(c), &s); err != nil {
+		return fmt.Errorf("failed to save field schemas: %v", err)
+	}
+	return nil
+}
+
+type fieldSchemasByName []FieldSchema
+
+func (f fieldSchemasByName) Len() int      { return len(f) }
+func (f fieldSchemasByName) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f fieldSchemasByName) Less(i, j int) bool {
+	return strings.ToLower(f[i].Name) < strings.ToLower(f[j].Name)
+}
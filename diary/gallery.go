@@ -0,0 +1,147 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// attachments shown on a page of the gallery
+const attachmentsPerPage = 48
+
+// showGallery lists all attachments, newest first and grouped by day. They
+// are queried by the Date linkAttachments copies from their entry, which the
+// built-in index on Attachment.Date covers; attachments not linked yet have
+// no date and those of trashed entries are left out.
+func showGallery(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	q := datastore.NewQuery("Attachment").Filter("Date >", time.Time{}).Order("-Date")
+	if raw := r.FormValue("cursor"); raw != "" {
+		cursor, err := datastore.DecodeCursor(raw)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		q = q.Start(cursor)
+	}
+
+	content := GalleryContent{Days: []GalleryDayContent{}}
+	if r.FormValue("cursor") != "" {
+		content.Newest = "/attachments"
+	}
+
+	var keys []*datastore.Key
+	var attachments []Attachment
+	var next datastore.Cursor
+	t := q.Run(c)
+	for {
+		var a Attachment
+		key, err := t.Next(&a)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			c.Errorf("failed to fetch attachments: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(keys) == attachmentsPerPage {
+			// there are more attachments to come
+			content.Older = "/attachments?cursor=" + next.String()
+			break
+		}
+
+		keys = append(keys, key)
+		attachments = append(attachments, a)
+		if len(keys) == attachmentsPerPage {
+			// the next page starts after the last attachment shown
+			if next, err = t.Cursor(); err != nil {
+				c.Errorf("failed to get cursor: %v", err)
+				break
+			}
+		}
+	}
+
+	trashed, err := trashedEntries(c, attachments)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i, a := range attachments {
+		if trashed[a.Entry.Encode()] {
+			continue
+		}
+		date := a.Date.In(loc)
+		day := date.Format(dateFormat)
+		if n := len(content.Days); n == 0 || content.Days[n-1].Day != day {
+			content.Days = append(content.Days, GalleryDayContent{
+				Date:   date,
+				Day:    day,
+				Photos: []GalleryPhotoContent{},
+			})
+		}
+		group := &content.Days[len(content.Days)-1]
+		group.Photos = append(group.Photos, GalleryPhotoContent{
+			AttachmentContent: AttachmentContent{
+				ID:        keys[i].Encode(),
+				Name:      a.Name,
+				Thumbnail: a.Thumbnail,
+				BigImage:  a.BigImage,
+				Key:       string(a.Content),
+			},
+			Entry: a.Entry.Encode(),
+		})
+	}
+
+	renderPage(c, w, galleryTemplate, "Attachments", content)
+}
+
+// trashedEntries returns the encoded keys of the entries of attachments that
+// don't exist anymore. Trashing an entry keeps the links of its attachments
+// for a restore, so they still turn up by date.
+func trashedEntries(c appengine.Context, attachments []Attachment) (map[string]bool, error) {
+	keys := []*datastore.Key{}
+	seen := map[string]bool{}
+	for _, a := range attachments {
+		if id := a.Entry.Encode(); !seen[id] {
+			seen[id] = true
+			keys = append(keys, a.Entry)
+		}
+	}
+
+	trashed := map[string]bool{}
+	if len(keys) == 0 {
+		return trashed, nil
+	}
+	entries := make([]DiaryEntry, len(keys))
+	err := datastore.GetMulti(c, keys, entries)
+	errs, partial := err.(appengine.MultiError)
+	if err != nil && !partial {
+		return nil, fmt.Errorf("failed to fetch entries: %v", err)
+	}
+	for i, key := range keys {
+		if !partial || errs[i] == nil {
+			continue
+		}
+		if errs[i] != datastore.ErrNoSuchEntity {
+			return nil, fmt.Errorf("failed to fetch entry '%v': %v", key, errs[i])
+		}
+		trashed[key.Encode()] = true
+	}
+	return trashed, nil
+}
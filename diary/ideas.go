@@ -0,0 +1,345 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Idea is an idea written down in an entry, tracked from there on. It is
+// created from lines tagged "idea" (see extractTags). Writing the same idea
+// down again, or referring to it as "idea #12", links the later entry to it.
+type Idea struct {
+	Text string `datastore:",noindex"`
+	// lower-cased Text, to recognise the idea when it is written down again,
+	// cut to the length of an indexed string
+	Normalized string
+	// the entry the idea was first written down in
+	Entry *datastore.Key
+	Date  time.Time
+	// later entries writing about the idea
+	Mentions     []*datastore.Key
+	Status       string
+	Notes        []byte
+	CreationTime time.Time
+	UpdateTime   time.Time
+}
+
+// the columns of the board, in this order
+const (
+	ideaNew       = "new"
+	ideaExploring = "exploring"
+	ideaDone      = "done"
+	ideaDropped   = "dropped"
+)
+
+var ideaStatuses = []string{ideaNew, ideaExploring, ideaDone, ideaDropped}
+
+var ideaReferenceRegexp = regexp.MustCompile(`(?i)\bidea #(\d+)\b`)
+
+// untouched ideas were never worked on, so they can go when their line does
+func (i Idea) untouched() bool {
+	return i.Status == ideaNew && len(i.Notes) == 0 && len(i.Mentions) == 0
+}
+
+// syncIdeasLater brings the ideas of an entry up to date in a task. Ideas are
+// in other entity groups, so they can't be updated in the transaction that
+// saves the entry; the task is only enqueued if that transaction succeeds.
+var syncIdeasLater = delay.Func("syncIdeas", syncIdeas)
+
+func syncIdeas(c appengine.Context, entryKey *datastore.Key) error {
+	var e DiaryEntry
+	err := datastore.Get(c, entryKey, &e)
+	if err == datastore.ErrNoSuchEntity {
+		// deleted, so it has no ideas anymore
+		e = DiaryEntry{}
+	} else if err != nil {
+		return fmt.Errorf("failed to fetch entry: %v", err)
+	}
+
+	extractors, err := loadExtractors(c)
+	if err != nil {
+		return err
+	}
+
+	texts := map[string]string{}
+	for _, l := range extractTags(extractors, e.Content) {
+		if l.Tag == "idea" && l.Text != "" {
+			texts[truncateIndexed(strings.ToLower(l.Text))] = l.Text
+		}
+	}
+	mentioned := map[int64]bool{}
+	for _, m := range ideaReferenceRegexp.FindAllStringSubmatch(string(e.Content), -1) {
+		id, _ := strconv.ParseInt(m[1], 10, 64)
+		mentioned[id] = true
+	}
+
+	// ideas first written down in this entry
+	var own []Idea
+	ownKeys, err := datastore.NewQuery("Idea").Filter("Entry =", entryKey).GetAll(c, &own)
+	if err != nil {
+		return fmt.Errorf("failed to fetch ideas of entry: %v", err)
+	}
+	for i, idea := range own {
+		if _, ok := texts[idea.Normalized]; ok {
+			delete(texts, idea.Normalized)
+			if !idea.Date.Equal(e.Date) {
+				idea.Date = e.Date
+				if _, err = datastore.Put(c, ownKeys[i], &idea); err != nil {
+					return fmt.Errorf("failed to save idea: %v", err)
+				}
+			}
+		} else if idea.untouched() {
+			if err = datastore.Delete(c, ownKeys[i]); err != nil {
+				return fmt.Errorf("failed to delete idea: %v", err)
+			}
+		}
+	}
+
+	for normalized, text := range texts {
+		var existing []Idea
+		keys, err := datastore.NewQuery("Idea").Filter("Normalized =", normalized).Limit(1).GetAll(c, &existing)
+		if err != nil {
+			return fmt.Errorf("failed to look up idea: %v", err)
+		}
+		if len(keys) == 0 {
+			idea := Idea{
+				Text:         text,
+				Normalized:   normalized,
+				Entry:        entryKey,
+				Date:         e.Date,
+				Status:       ideaNew,
+				CreationTime: time.Now(),
+				UpdateTime:   time.Now(),
+			}
+			if _, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Idea", nil), &idea); err != nil {
+				return fmt.Errorf("failed to save idea: %v", err)
+			}
+			continue
+		}
+
+		idea := existing[0]
+		if e.Date.Before(idea.Date) {
+			// written down earlier than we knew, e.g. when reindexing
+			idea.Mentions = append(removeKey(idea.Mentions, entryKey), idea.Entry)
+			idea.Entry = entryKey
+			idea.Date = e.Date
+			if _, err = datastore.Put(c, keys[0], &idea); err != nil {
+				return fmt.Errorf("failed to save idea: %v", err)
+			}
+		} else {
+			mentioned[keys[0].IntID()] = true
+		}
+	}
+
+	// link and unlink mentions
+	var linked []Idea
+	linkedKeys, err := datastore.NewQuery("Idea").Filter("Mentions =", entryKey).GetAll(c, &linked)
+	if err != nil {
+		return fmt.Errorf("failed to fetch ideas mentioned by entry: %v", err)
+	}
+	for i, idea := range linked {
+		if mentioned[linkedKeys[i].IntID()] {
+			delete(mentioned, linkedKeys[i].IntID())
+			continue
+		}
+		idea.Mentions = removeKey(idea.Mentions, entryKey)
+		if _, err = datastore.Put(c, linkedKeys[i], &idea); err != nil {
+			return fmt.Errorf("failed to save idea: %v", err)
+		}
+	}
+	for id := range mentioned {
+		key := datastore.NewKey(c, "Idea", "", id, nil)
+		var idea Idea
+		if err = datastore.Get(c, key, &idea); err == datastore.ErrNoSuchEntity {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to fetch idea: %v", err)
+		}
+		if idea.Entry.Equal(entryKey) {
+			continue
+		}
+		idea.Mentions = append(idea.Mentions, entryKey)
+		if _, err = datastore.Put(c, key, &idea); err != nil {
+			return fmt.Errorf("failed to save idea: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func showIdeaBoard(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	var ideas []Idea
+	keys, err := datastore.NewQuery("Idea").Order("-Date").GetAll(c, &ideas)
+	if err != nil {
+		c.Errorf("failed to load ideas: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	content := IdeaBoardContent{Columns: []IdeaColumnContent{}}
+	columns := map[string]int{}
+	for i, status := range ideaStatuses {
+		columns[status] = i
+		content.Columns = append(content.Columns, IdeaColumnContent{
+			Status: status,
+			Ideas:  []IdeaContent{},
+		})
+	}
+	for i, idea := range ideas {
+		column := content.Columns[columns[idea.Status]]
+		column.Ideas = append(column.Ideas, newIdeaContent(keys[i], idea, loc))
+		content.Columns[columns[idea.Status]] = column
+	}
+
+	renderPage(c, w, ideaBoardTemplate, "Ideas", content)
+}
+
+func newIdeaContent(key *datastore.Key, idea Idea, loc *time.Location) IdeaContent {
+	content := IdeaContent{
+		ID:       key.IntID(),
+		Text:     idea.Text,
+		Status:   idea.Status,
+		Notes:    string(idea.Notes),
+		Date:     idea.Date.In(loc),
+		Entry:    idea.Entry.Encode(),
+		Mentions: []IdeaMentionContent{},
+		Statuses: ideaStatuses,
+	}
+	for _, m := range idea.Mentions {
+		content.Mentions = append(content.Mentions, IdeaMentionContent{Key: m.Encode()})
+	}
+	return content
+}
+
+// decodeIdeaKey parses the id of an Idea passed as form value "id" or as last
+// part of the path. It writes an error response and returns nil if that fails.
+func decodeIdeaKey(c appengine.Context, w http.ResponseWriter, r *http.Request) *datastore.Key {
+	rawID := r.FormValue("id")
+	if rawID == "" {
+		rawID = strings.TrimPrefix(r.URL.Path, "/ideas/")
+	}
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid idea", http.StatusBadRequest)
+		return nil
+	}
+	return datastore.NewKey(c, "Idea", "", id, nil)
+}
+
+func showIdea(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	if strings.TrimPrefix(r.URL.Path, "/ideas/") == "" {
+		showIdeaBoard(w, r)
+		return
+	}
+
+	key := decodeIdeaKey(c, w, r)
+	if key == nil {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	var idea Idea
+	if err = datastore.Get(c, key, &idea); err != nil {
+		c.Errorf("failed to fetch idea: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	content := newIdeaContent(key, idea, loc)
+
+	// the board only counts mentions, here they are listed by date
+	entries := make([]DiaryEntry, len(idea.Mentions))
+	err = datastore.GetMulti(c, idea.Mentions, entries)
+	errs, partial := err.(appengine.MultiError)
+	if err != nil && !partial {
+		c.Errorf("failed to fetch mentions: %v", err)
+	}
+	for i, e := range entries {
+		if err == nil || (partial && errs[i] == nil) {
+			content.Mentions[i].Date = e.Date.In(loc)
+		}
+	}
+
+	renderPage(c, w, ideaTemplate, idea.Text, content)
+}
+
+// updateIdea changes the status and, if the form has them, the notes of an
+// idea.
+func updateIdea(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	key := decodeIdeaKey(c, w, r)
+	if key == nil {
+		return
+	}
+
+	status := r.FormValue("status")
+	valid := false
+	for _, s := range ideaStatuses {
+		valid = valid || s == status
+	}
+	if !valid {
+		http.Error(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var idea Idea
+		if err := datastore.Get(c, key, &idea); err != nil {
+			return fmt.Errorf("failed to fetch idea: %v", err)
+		}
+		idea.Status = status
+		if _, ok := r.Form["notes"]; ok {
+			idea.Notes = []byte(strings.TrimSpace(r.FormValue("notes")))
+		}
+		idea.UpdateTime = time.Now()
+		_, err := datastore.Put(c, key, &idea)
+		return err
+	}, nil)
+	if err != nil {
+		c.Errorf("failed to update idea: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	location := "/ideas"
+	if r.FormValue("return") == "idea" {
+		location = fmt.Sprintf("/ideas/%v", key.IntID())
+	}
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusFound)
+}
@@ -0,0 +1,195 @@
+package diary
+
+import (
+	"regexp"
+	"strings"
+)
+
+// parseMarkdown parses the subset of Markdown we support in entries:
+// headings, lists with optional checkboxes, quotes, fenced code, rules,
+// emphasis, inline code and links. Anything else is plain text. Unlike
+// standard Markdown, single line breaks within a paragraph are kept, since
+// they were made by the user in the reply mail.
+func parseMarkdown(content string) []Block {
+	p := &markdownParser{}
+	for _, line := range strings.Split(content, "\n") {
+		p.line(strings.TrimRight(line, " \r\t"))
+	}
+	p.flush()
+	return p.blocks
+}
+
+var (
+	headingRegexp  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	listItemRegexp = regexp.MustCompile(`^\s{0,3}([-*+]|\d+[.)])\s+(.*)$`)
+	checkboxRegexp = regexp.MustCompile(`^\[([ xX])\]\s+(.*)$`)
+	ruleRegexp     = regexp.MustCompile(`^\s{0,3}([-*_])(\s*([-*_])){2,}$`)
+	quoteRegexp    = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+	fenceRegexp    = regexp.MustCompile("^\\s{0,3}```")
+)
+
+type markdownParser struct {
+	blocks []Block
+	// lines of the paragraph or quote being collected
+	lines []string
+	kind  string
+	list  *Block
+	code  *Block
+}
+
+func (p *markdownParser) line(line string) {
+	if p.code != nil {
+		if fenceRegexp.MatchString(line) {
+			p.blocks = append(p.blocks, *p.code)
+			p.code = nil
+		} else {
+			p.code.Text += line + "\n"
+		}
+		return
+	}
+
+	switch {
+	case strings.TrimSpace(line) == "":
+		p.flush()
+
+	case fenceRegexp.MatchString(line):
+		p.flush()
+		p.code = &Block{Kind: "code"}
+
+	case headingRegexp.MatchString(line):
+		p.flush()
+		m := headingRegexp.FindStringSubmatch(line)
+		p.blocks = append(p.blocks, Block{
+			Kind:    "heading",
+			Level:   len(m[1]),
+			Inlines: parseInlines(m[2]),
+		})
+
+	case ruleRegexp.MatchString(line):
+		p.flush()
+		p.blocks = append(p.blocks, Block{Kind: "rule"})
+
+	case listItemRegexp.MatchString(line):
+		m := listItemRegexp.FindStringSubmatch(line)
+		ordered := !strings.ContainsAny(m[1], "-*+")
+		if p.list == nil || p.list.Ordered != ordered {
+			p.flush()
+			p.list = &Block{Kind: "list", Ordered: ordered}
+		}
+
+		item := ListItem{}
+		text := m[2]
+		if c := checkboxRegexp.FindStringSubmatch(text); c != nil {
+			item.Checkbox = true
+			item.Checked = c[1] != " "
+			text = c[2]
+		}
+		item.Inlines = parseInlines(text)
+		p.list.Items = append(p.list.Items, item)
+
+	case p.list != nil && strings.HasPrefix(line, " "):
+		// continuation of the last list item
+		last := &p.list.Items[len(p.list.Items)-1]
+		last.Inlines = append(last.Inlines, Inline{Kind: "break"})
+		last.Inlines = append(last.Inlines, parseInlines(strings.TrimSpace(line))...)
+
+	case quoteRegexp.MatchString(line):
+		if p.kind != "quote" {
+			p.flush()
+			p.kind = "quote"
+		}
+		p.lines = append(p.lines, quoteRegexp.FindStringSubmatch(line)[1])
+
+	default:
+		if p.kind != "paragraph" {
+			p.flush()
+			p.kind = "paragraph"
+		}
+		p.lines = append(p.lines, line)
+	}
+}
+
+// flush finishes the paragraph, quote or list being collected.
+func (p *markdownParser) flush() {
+	if p.list != nil {
+		p.blocks = append(p.blocks, *p.list)
+		p.list = nil
+	}
+	if len(p.lines) > 0 {
+		block := Block{Kind: p.kind}
+		for i, line := range p.lines {
+			if i > 0 {
+				block.Inlines = append(block.Inlines, Inline{Kind: "break"})
+			}
+			block.Inlines = append(block.Inlines, parseInlines(line)...)
+		}
+		p.blocks = append(p.blocks, block)
+	}
+	p.lines = nil
+	p.kind = ""
+
+	// an unterminated code block runs until the end of the entry
+	if p.code != nil {
+		p.blocks = append(p.blocks, *p.code)
+		p.code = nil
+	}
+}
+
+var inlineRegexp = regexp.MustCompile(
+	"`([^`]+)`" + // 1: code
+		`|\*\*(.+?)\*\*|__(.+?)__` + // 2, 3: strong
+		`|\*(\S(?:.*?\S)?)\*|\b_(\S(?:.*?\S)?)_\b` + // 4, 5: emphasis
+		`|\[([^\]]+)\]\(([^)\s]+)\)` + // 6, 7: link
+		`|(https?://[^\s<>()]+[^\s<>().,;:!?'"])` + // 8: bare URL
+		`|\b([Ii]dea #(\d+))\b`) // 9, 10: reference to an idea
+
+// parseInlines splits a line of text into plain text, emphasis, code and links.
+func parseInlines(text string) []Inline {
+	inlines := []Inline{}
+	for text != "" {
+		m := inlineRegexp.FindStringSubmatchIndex(text)
+		if m == nil {
+			inlines = append(inlines, Inline{Kind: "text", Text: text})
+			break
+		}
+		if m[0] > 0 {
+			inlines = append(inlines, Inline{Kind: "text", Text: text[:m[0]]})
+		}
+
+		group := func(i int) string {
+			if m[2*i] < 0 {
+				return ""
+			}
+			return text[m[2*i]:m[2*i+1]]
+		}
+
+		switch {
+		case m[2] >= 0:
+			inlines = append(inlines, Inline{Kind: "code", Text: group(1)})
+		case m[4] >= 0 || m[6] >= 0:
+			inlines = append(inlines, Inline{Kind: "strong", Text: group(2) + group(3)})
+		case m[8] >= 0 || m[10] >= 0:
+			inlines = append(inlines, Inline{Kind: "emphasis", Text: group(4) + group(5)})
+		case m[12] >= 0:
+			inlines = append(inlines, newLink(group(6), group(7)))
+		case m[16] >= 0:
+			inlines = append(inlines, newLink(group(8), group(8)))
+		default:
+			inlines = append(inlines, newLink(group(9), "/ideas/"+group(10)))
+		}
+		text = text[m[1]:]
+	}
+	return inlines
+}
+
+// newLink only keeps links to schemes that are safe to follow, others are
+// shown as plain text.
+func newLink(text, url string) Inline {
+	lower := strings.ToLower(url)
+	for _, prefix := range []string{"http://", "https://", "mailto:", "/"} {
+		if strings.HasPrefix(lower, prefix) && !strings.HasPrefix(lower, "//") {
+			return Inline{Kind: "link", Text: text, URL: url}
+		}
+	}
+	return Inline{Kind: "text", Text: text}
+}
@@ -0,0 +1,214 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mood and energy are scored from 1 to 10 on the first line of a reply, either
+// written out ("mood: 7, energy: 4") or as one of the emoji below, at the
+// start of the line or on a line of scores only. The scores are stored on the
+// entry and removed from its text.
+
+var (
+	moodRegexp   = regexp.MustCompile(`(?i)\b(?:mood|stimmung)\s*[:=]?\s*(\d+)(?:\s*/\s*10)?`)
+	energyRegexp = regexp.MustCompile(`(?i)\b(?:energy|energie)\s*[:=]?\s*(\d+)(?:\s*/\s*10)?`)
+	// what may be left of a line that only held scores
+	scoreSeparatorRegexp = regexp.MustCompile(`^[\s,;|·\x{FE0F}-]*$`)
+)
+
+var moodEmoji = map[string]int{
+	"😄": 9, "😁": 9, "😊": 8, "🙂": 7, "😐": 5, "😕": 4, "🙁": 3, "😞": 3, "😢": 2, "😭": 1, "😡": 2,
+}
+
+var energyEmoji = map[string]int{
+	"⚡": 9, "🔋": 7, "🪫": 3, "😴": 2,
+}
+
+// parseScores takes mood and energy from the first line of body. If the line
+// held nothing else it is removed, otherwise only the scores are. Scores
+// that weren't given are 0.
+func parseScores(body string) (mood, energy int, rest string) {
+	body = strings.TrimLeft(body, "\r\n\t ")
+	lines := strings.SplitN(body, "\n", 2)
+	line := lines[0]
+
+	// emoji anywhere but at the start are only scores if the line holds
+	// nothing else, otherwise they're part of the text
+	anywhere := onlyScores(line)
+	mood, line = takeScore(line, moodRegexp, moodEmoji, anywhere)
+	energy, line = takeScore(line, energyRegexp, energyEmoji, anywhere)
+	if mood == 0 && energy == 0 {
+		return 0, 0, body
+	}
+
+	if scoreSeparatorRegexp.MatchString(line) {
+		lines = lines[1:]
+	} else {
+		lines[0] = strings.TrimSpace(line)
+	}
+	return mood, energy, strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// onlyScores reports whether line consists of nothing but scores.
+func onlyScores(line string) bool {
+	line = moodRegexp.ReplaceAllString(line, "")
+	line = energyRegexp.ReplaceAllString(line, "")
+	for _, emoji := range []map[string]int{moodEmoji, energyEmoji} {
+		for e := range emoji {
+			line = strings.Replace(line, e, "", -1)
+		}
+	}
+	return scoreSeparatorRegexp.MatchString(line)
+}
+
+// takeScore returns the first valid score found in line and line without it.
+// Emoji only count at the start of the line, unless anywhere is set.
+func takeScore(line string, re *regexp.Regexp, emoji map[string]int, anywhere bool) (int, string) {
+	if m := re.FindStringSubmatchIndex(line); m != nil {
+		score, err := strconv.Atoi(line[m[2]:m[3]])
+		if err == nil && score >= 1 && score <= 10 {
+			return score, line[:m[0]] + line[m[1]:]
+		}
+	}
+
+	start := len(line) - len(strings.TrimLeft(line, " \t,;|·-"))
+	if !anywhere {
+		for e, s := range emoji {
+			if strings.HasPrefix(line[start:], e) {
+				return s, line[:start] + line[start+len(e):]
+			}
+		}
+		return 0, line
+	}
+
+	// the first emoji counts, wherever it is in the map
+	first, score, length := -1, 0, 0
+	for e, s := range emoji {
+		if i := strings.Index(line, e); i >= 0 && (first < 0 || i < first) {
+			first, score, length = i, s, len(e)
+		}
+	}
+	if first < 0 {
+		return 0, line
+	}
+	return score, line[:first] + line[first+length:]
+}
+
+const (
+	defaultMoodDays = 90
+	chartWidth      = 600
+	chartHeight     = 200
+)
+
+// showMood charts mood and energy of the last days, ?days=365 for a year.
+func showMood(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < 7 {
+		days = defaultMoodDays
+	}
+	end := startOfDay(time.Now().In(loc)).AddDate(0, 0, 1)
+	start := end.AddDate(0, 0, -days)
+
+	var entries []DiaryEntry
+	_, err = datastore.NewQuery("DiaryEntry").
+		Filter("Date >=", start).
+		Order("Date").
+		GetAll(c, &entries)
+	if err != nil {
+		c.Errorf("failed to fetch entries: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	mood := newScoreSeries("mood", start, days)
+	energy := newScoreSeries("energy", start, days)
+	for _, e := range entries {
+		date := e.Date.In(loc)
+		// a later entry of the same day wins
+		if e.Mood > 0 {
+			mood.add(date, e.Mood)
+		}
+		if e.Energy > 0 {
+			energy.add(date, e.Energy)
+		}
+	}
+
+	content := MoodContent{
+		Days:   days,
+		Start:  start,
+		End:    end.AddDate(0, 0, -1),
+		Width:  chartWidth,
+		Height: chartHeight,
+		Mood:   mood.content(),
+		Energy: energy.content(),
+	}
+
+	renderPage(c, w, moodTemplate, "Mood", content)
+}
+
+// scoreSeries collects one score per day and turns them into chart points.
+type scoreSeries struct {
+	name   string
+	start  time.Time
+	days   int
+	scores map[int]int
+}
+
+func newScoreSeries(name string, start time.Time, days int) *scoreSeries {
+	return &scoreSeries{
+		name:   name,
+		start:  start,
+		days:   days,
+		scores: map[int]int{},
+	}
+}
+
+func (s *scoreSeries) add(date time.Time, score int) {
+	day := int(startOfDay(date).Sub(s.start).Hours()+12) / 24
+	s.scores[day] = score
+}
+
+func (s *scoreSeries) content() ScoreSeriesContent {
+	content := ScoreSeriesContent{Name: s.name, Points: []ChartPointContent{}}
+	sum := 0
+	coords := []string{}
+	for day := 0; day < s.days; day++ {
+		score, ok := s.scores[day]
+		if !ok {
+			continue
+		}
+		p := ChartPointContent{
+			X:     day * chartWidth / s.days,
+			Y:     chartHeight - score*chartHeight/10,
+			Date:  s.start.AddDate(0, 0, day),
+			Score: score,
+		}
+		content.Points = append(content.Points, p)
+		coords = append(coords, fmt.Sprintf("%v,%v", p.X, p.Y))
+		sum += score
+	}
+	content.Line = strings.Join(coords, " ")
+	if len(content.Points) > 0 {
+		content.Average = fmt.Sprintf("%.1f", float64(sum)/float64(len(content.Points)))
+	}
+	return content
+}
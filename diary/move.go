@@ -0,0 +1,196 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// moveEntry shows the form for filing an entry under a different day.
+func moveEntry(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	key := decodeEntryKey(c, w, r)
+	if key == nil {
+		return
+	}
+
+	var e DiaryEntry
+	if err := datastore.Get(c, key, &e); err != nil {
+		c.Errorf("failed to fetch entry: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	renderMove(c, w, key, e, e.Date.In(loc).Format(dateFormat), nil, nil, loc)
+}
+
+// moveEntrySubmit changes the date of an entry. If the target day already has
+// entries the form is shown again listing them, and the entry is only merged
+// into one of them when that is chosen with the form value "merge".
+func moveEntrySubmit(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	key := decodeEntryKey(c, w, r)
+	if key == nil {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	target := r.FormValue("date")
+	day, err := time.ParseInLocation(dateFormat, target, loc)
+	if err != nil {
+		http.Error(w, "invalid date", http.StatusBadRequest)
+		return
+	}
+
+	var e DiaryEntry
+	if err = datastore.Get(c, key, &e); err != nil {
+		c.Errorf("failed to fetch entry: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	keys, entries, err := loadEntries(c, target, loc)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the entry itself doesn't get in the way when only its time changes
+	otherKeys := []*datastore.Key{}
+	others := []DiaryEntry{}
+	for i, k := range keys {
+		if !k.Equal(key) {
+			otherKeys = append(otherKeys, k)
+			others = append(others, entries[i])
+		}
+	}
+
+	if rawMerge := r.FormValue("merge"); rawMerge != "" {
+		mergeKey, err := datastore.DecodeKey(rawMerge)
+		if err != nil {
+			c.Errorf("Failed to parse decode key '%v': %v", rawMerge, err)
+			http.Error(w, "invalid merge target", http.StatusBadRequest)
+			return
+		}
+		found := false
+		for _, k := range otherKeys {
+			found = found || k.Equal(mergeKey)
+		}
+		if !found {
+			http.Error(w, "the merge target is not on "+target+" anymore, please try again", http.StatusConflict)
+			return
+		}
+
+		if err = mergeEntries(c, mergeKey, key); err != nil {
+			c.Errorf("%v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Location", "/entry/"+target)
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+
+	if len(others) > 0 {
+		renderMove(c, w, key, e, target, otherKeys, others, loc)
+		return
+	}
+
+	// keep the time of day, only the day changes
+	old := e.Date.In(loc)
+	e.Date = day.Add(old.Sub(startOfDay(old)))
+	settings, err := loadEntrySettings(c)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err = putEntry(c, key, &e, settings); err != nil {
+		c.Errorf("failed to save entry: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/entry/"+target)
+	w.WriteHeader(http.StatusFound)
+}
+
+func renderMove(c appengine.Context, w http.ResponseWriter, key *datastore.Key, e DiaryEntry, target string, conflictKeys []*datastore.Key, conflicts []DiaryEntry, loc *time.Location) {
+	content := MoveContent{
+		Date:      e.Date.In(loc),
+		Key:       key.Encode(),
+		Target:    target,
+		Sections:  newSectionContents(e, loc),
+		Conflicts: []EntryContent{},
+	}
+
+	if len(conflicts) > 0 {
+		attachments := newAttachmentCache(c)
+		if err := attachments.Prefetch(conflicts); err != nil {
+			c.Errorf("%v", err)
+		}
+		for i, other := range conflicts {
+			content.Conflicts = append(content.Conflicts, newEntryContent(conflictKeys[i], other, attachments, loc))
+		}
+	}
+
+	renderPage(c, w, moveTemplate, "Move "+content.Date.Format("Monday, 2. Jan"), content)
+}
+
+// mergeEntries appends the sections and attachments of the entry at from to
+// the entry at into and moves the former to the trash, all in one
+// transaction.
+func mergeEntries(c appengine.Context, into, from *datastore.Key) error {
+	settings, err := loadEntrySettings(c)
+	if err != nil {
+		return err
+	}
+
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var target, source DiaryEntry
+		err := datastore.GetMulti(c, []*datastore.Key{into, from}, []interface{}{&target, &source})
+		if err != nil {
+			return fmt.Errorf("failed to fetch entries: %v", err)
+		}
+
+		target.Sections = append(entrySections(target), entrySections(source)...)
+		target.Attachments = append(target.Attachments, source.Attachments...)
+		if target.Prompt == "" {
+			target.Prompt = source.Prompt
+		}
+
+		if _, err = putRevision(c, into, &target, sourceWeb, settings); err != nil {
+			return err
+		}
+
+		// the attachments now belong to the target, so they have to stay when
+		// the merged entry is purged from the trash
+		source.Attachments = nil
+		return putInTrash(c, from, source)
+	}, xg)
+}
@@ -0,0 +1,165 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+	"net/http"
+	"time"
+)
+
+// Draft is the autosaved state of the new entry form. There is only one.
+type Draft struct {
+	Date       string
+	Content    []byte
+	UpdateTime time.Time
+}
+
+func draftKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Draft", "new", 0, nil)
+}
+
+func newEntry(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	// uploads have to go through the blobstore, which then calls newEntrySubmit
+	uploadURL, err := blobstore.UploadURL(c, "/new_submit", nil)
+	if err != nil {
+		c.Errorf("failed to create upload url: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	content := NewEntryContent{
+		UploadURL: uploadURL.String(),
+		Date:      time.Now().In(loc).Format(dateFormat),
+	}
+
+	var d Draft
+	err = datastore.Get(c, draftKey(c), &d)
+	if err == nil {
+		content.Content = string(d.Content)
+		if d.Date != "" {
+			content.Date = d.Date
+		}
+		content.DraftTime = d.UpdateTime.In(loc)
+	} else if err != datastore.ErrNoSuchEntity {
+		c.Errorf("failed to load draft: %v", err)
+	}
+	// missing days on the calendar link here with their date
+	if date := r.FormValue("date"); date != "" {
+		content.Date = date
+	}
+
+	renderPage(c, w, newEntryTemplate, "New entry", content)
+}
+
+func newEntrySubmit(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	blobs, values, err := blobstore.ParseUpload(r)
+	if err != nil {
+		c.Errorf("failed to parse upload: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	date, err := time.ParseInLocation(dateFormat, values.Get("date"), loc)
+	if err != nil {
+		http.Error(w, "invalid date", http.StatusBadRequest)
+		return
+	}
+
+	attachments := []*datastore.Key{}
+	for _, blob := range blobs["attachments"] {
+		key, err := saveAttachment(c, blob.BlobKey, blob.Filename, blob.ContentType)
+		if err != nil {
+			c.Errorf("error while storing attachments: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		attachments = append(attachments, key)
+	}
+
+	mood, energy, content := parseScores(values.Get("content"))
+	if content == "" && len(attachments) == 0 {
+		w.Header().Set("Location", "/new")
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+
+	e := DiaryEntry{
+		Author:       diaryAuthor,
+		Date:         date,
+		CreationTime: time.Now(),
+		Attachments:  attachments,
+		Mood:         mood,
+		Energy:       energy,
+		Sections: []Section{{
+			Text:         []byte(content),
+			Source:       sourceWeb,
+			CreationTime: time.Now(),
+		}},
+	}
+
+	_, err = saveEntry(c, datastore.NewIncompleteKey(c, "DiaryEntry", nil), &e, sourceWeb, nil)
+	if err != nil {
+		c.Errorf("Failed to save to datastore: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = datastore.Delete(c, draftKey(c)); err != nil && err != datastore.ErrNoSuchEntity {
+		c.Errorf("failed to delete draft: %v", err)
+	}
+
+	w.Header().Set("Location", "/entry/"+date.Format(dateFormat))
+	w.WriteHeader(http.StatusFound)
+}
+
+// saveDraft is called by the new entry form whenever its content changes.
+func saveDraft(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "drafts have to be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	d := Draft{
+		Date:       r.FormValue("date"),
+		Content:    []byte(r.FormValue("content")),
+		UpdateTime: time.Now(),
+	}
+	if _, err := datastore.Put(c, draftKey(c), &d); err != nil {
+		c.Errorf("failed to save draft: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
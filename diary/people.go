@@ -0,0 +1,293 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PeopleSettings holds the alias list, one person per line with the names
+// they go by in entries:
+//
+//	Mum: Mama, Mutti, @mama
+//
+// Names starting with @ only match mentions, others match anywhere in the
+// text. Mentions nobody claims are people of their own.
+type PeopleSettings struct {
+	Aliases []byte
+}
+
+// aliases maps lower-cased names, mentions with their @, to people.
+type aliases map[string]string
+
+func peopleSettingsKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "PeopleSettings", "default", 0, nil)
+}
+
+func loadPeopleSettings(c appengine.Context) (PeopleSettings, error) {
+	var s PeopleSettings
+	err := datastore.Get(c, peopleSettingsKey(c), &s)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return s, fmt.Errorf("failed to load people settings: %v", err)
+	}
+	return s, nil
+}
+
+func parseAliases(text []byte) (aliases, error) {
+	a := aliases{}
+	for i, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		person := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || person == "" {
+			return nil, fmt.Errorf("line %v: expected 'Name: alias, alias', got '%v'", i+1, line)
+		}
+
+		// the name itself is always an alias for mentions
+		a["@"+strings.ToLower(strings.Replace(person, " ", "", -1))] = person
+		for _, name := range strings.Split(parts[1], ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" || name == "@" {
+				continue
+			}
+			if other, ok := a[name]; ok && other != person {
+				return nil, fmt.Errorf("line %v: '%v' is already an alias of %v", i+1, name, other)
+			}
+			a[name] = person
+		}
+	}
+	return a, nil
+}
+
+// wordRegexp matches the aliases that aren't mentions as whole words.
+func (a aliases) wordRegexp() *regexp.Regexp {
+	words := []string{}
+	for name := range a {
+		if !strings.HasPrefix(name, "@") {
+			words = append(words, regexp.QuoteMeta(name))
+		}
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	// longest first, so "uncle bob" wins over "bob"
+	sort.Sort(sort.Reverse(byLength(words)))
+	return regexp.MustCompile(`(?i)(?:^|[^\pL\pN])(` + strings.Join(words, "|") + `)(?:[^\pL\pN]|$)`)
+}
+
+type byLength []string
+
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Less(i, j int) bool { return len(s[i]) < len(s[j]) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// findPeople returns the people an entry is about, given its content and the
+// tags extracted from it.
+func findPeople(a aliases, content []byte, tags []string) []string {
+	seen := map[string]bool{}
+	people := []string{}
+	add := func(person string) {
+		if !seen[person] {
+			seen[person] = true
+			people = append(people, person)
+		}
+	}
+
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "@") {
+			continue
+		}
+		if person, ok := a[tag]; ok {
+			add(person)
+		} else {
+			add(strings.TrimPrefix(tag, "@"))
+		}
+	}
+	if re := a.wordRegexp(); re != nil {
+		for _, m := range re.FindAllSubmatch(content, -1) {
+			add(a[strings.ToLower(string(m[1]))])
+		}
+	}
+	return people
+}
+
+func showPeople(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	s, err := loadPeopleSettings(c)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderPeople(c, w, string(s.Aliases), "")
+}
+
+func renderPeople(c appengine.Context, w http.ResponseWriter, aliasText, errMsg string) {
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	// one result per person and entry
+	var entries []DiaryEntry
+	_, err = datastore.NewQuery("DiaryEntry").Project("People", "Date").GetAll(c, &entries)
+	if err != nil {
+		c.Errorf("failed to load people: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	people := map[string]*PersonContent{}
+	for _, e := range entries {
+		for _, name := range e.People {
+			p, ok := people[name]
+			date := e.Date.In(loc)
+			if !ok {
+				p = &PersonContent{Name: name, First: date, Last: date}
+				people[name] = p
+			}
+			p.Entries++
+			if date.Before(p.First) {
+				p.First = date
+			}
+			if date.After(p.Last) {
+				p.Last = date
+			}
+		}
+	}
+
+	content := PeopleContent{
+		People:  []PersonContent{},
+		Aliases: aliasText,
+		Error:   errMsg,
+	}
+	for _, p := range people {
+		content.People = append(content.People, *p)
+	}
+	sort.Sort(peopleByEntries(content.People))
+
+	renderPage(c, w, peopleTemplate, "People", content)
+}
+
+type peopleByEntries []PersonContent
+
+func (p peopleByEntries) Len() int      { return len(p) }
+func (p peopleByEntries) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p peopleByEntries) Less(i, j int) bool {
+	if p[i].Entries != p[j].Entries {
+		return p[i].Entries > p[j].Entries
+	}
+	return p[i].Name < p[j].Name
+}
+
+func saveAliases(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	text := r.FormValue("aliases")
+	if _, err := parseAliases([]byte(text)); err != nil {
+		renderPeople(c, w, text, err.Error())
+		return
+	}
+
+	s := PeopleSettings{Aliases: []byte(text)}
+	if _, err := datastore.Put(c, peopleSettingsKey(c), &s); err != nil {
+		c.Errorf("failed to save people settings: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/people")
+	w.WriteHeader(http.StatusFound)
+}
+
+// showPerson lists every entry a person appears in, with the number of
+// entries per month.
+func showPerson(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/people/")
+	if name == "" {
+		showPeople(w, r)
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	var entries []DiaryEntry
+	keys, err := datastore.NewQuery("DiaryEntry").Filter("People =", name).Order("-Date").GetAll(c, &entries)
+	if err != nil {
+		c.Errorf("failed to fetch entries of '%v': %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	content := PersonContent{
+		Name:    name,
+		Entries: len(entries),
+		First:   entries[len(entries)-1].Date.In(loc),
+		Last:    entries[0].Date.In(loc),
+		Months:  []MonthCountContent{},
+		List:    []EntryContent{},
+	}
+
+	// every month from the first mention to the last, including empty ones
+	counts := map[string]int{}
+	for _, e := range entries {
+		counts[e.Date.In(loc).Format("2006-01")]++
+	}
+	most := 0
+	for _, n := range counts {
+		if n > most {
+			most = n
+		}
+	}
+	first := content.First
+	for m := time.Date(first.Year(), first.Month(), 1, 0, 0, 0, 0, loc); !m.After(content.Last); m = m.AddDate(0, 1, 0) {
+		n := counts[m.Format("2006-01")]
+		content.Months = append(content.Months, MonthCountContent{
+			Month:   m,
+			Entries: n,
+			Percent: 100 * n / most,
+		})
+	}
+
+	attachments := newAttachmentCache(c)
+	if err = attachments.Prefetch(entries); err != nil {
+		c.Errorf("%v", err)
+	}
+	for i, e := range entries {
+		content.List = append(content.List, newEntryContent(keys[i], e, attachments, loc))
+	}
+
+	renderPage(c, w, personTemplate, name, content)
+}
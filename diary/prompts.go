@@ -0,0 +1,301 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prompt is a writing prompt offered as question of the day in the reminder.
+// Built-in prompts live in builtinPrompts, user-supplied ones in the datastore.
+type Prompt struct {
+	Text         string
+	Themes       []string
+	CreationTime time.Time
+}
+
+// PromptSettings controls which prompts are drawn and how often they may repeat.
+type PromptSettings struct {
+	// number of days a prompt is not used again after it was sent
+	Window int
+	// only draw prompts with one of these themes, all prompts if empty
+	Themes []string
+}
+
+// Reminder records a sent reminder, so we know which prompt a reply answered
+// and which prompts were used recently.
+type Reminder struct {
+	Tag      string
+	Date     time.Time
+	Prompt   string
+	SentTime time.Time
+}
+
+const defaultPromptWindow = 30
+
+var builtinPrompts = []Prompt{
+	{Text: "What made you smile today?", Themes: []string{"gratitude"}},
+	{Text: "What are you grateful for today?", Themes: []string{"gratitude"}},
+	{Text: "Who did you spend time with today?", Themes: []string{"people"}},
+	{Text: "Who would you like to see again soon?", Themes: []string{"people"}},
+	{Text: "What did you learn today?", Themes: []string{"growth"}},
+	{Text: "What would you do differently if you could redo today?", Themes: []string{"growth"}},
+	{Text: "What was the hardest part of your day?", Themes: []string{"reflection"}},
+	{Text: "How did you feel when you woke up this morning?", Themes: []string{"reflection"}},
+	{Text: "What are you looking forward to tomorrow?", Themes: []string{"future"}},
+	{Text: "What is one thing you want to get done this week?", Themes: []string{"future"}},
+}
+
+func promptSettingsKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "PromptSettings", "default", 0, nil)
+}
+
+func loadPromptSettings(c appengine.Context) (PromptSettings, error) {
+	var s PromptSettings
+	err := datastore.Get(c, promptSettingsKey(c), &s)
+	if err == datastore.ErrNoSuchEntity {
+		return PromptSettings{Window: defaultPromptWindow}, nil
+	} else if err != nil {
+		return PromptSettings{}, fmt.Errorf("failed to load prompt settings: %v", err)
+	}
+	return s, nil
+}
+
+// loadPrompts returns the built-in prompts followed by the user-supplied ones.
+func loadPrompts(c appengine.Context) ([]Prompt, []*datastore.Key, error) {
+	var stored []Prompt
+	keys, err := datastore.NewQuery("Prompt").Order("CreationTime").GetAll(c, &stored)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load prompts: %v", err)
+	}
+
+	prompts := append(append([]Prompt{}, builtinPrompts...), stored...)
+	allKeys := append(make([]*datastore.Key, len(builtinPrompts)), keys...)
+	return prompts, allKeys, nil
+}
+
+// choosePrompt draws a random prompt matching the configured themes which
+// hasn't been sent within the configured window. If every candidate was used
+// recently, repeats are allowed again.
+func choosePrompt(c appengine.Context, now time.Time) (string, error) {
+	settings, err := loadPromptSettings(c)
+	if err != nil {
+		return "", err
+	}
+
+	prompts, _, err := loadPrompts(c)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := []string{}
+	for _, p := range prompts {
+		if len(settings.Themes) == 0 || hasCommonTheme(p.Themes, settings.Themes) {
+			candidates = append(candidates, p.Text)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+
+	used := map[string]bool{}
+	cutoff := now.Add(-time.Duration(settings.Window) * 24 * time.Hour)
+	var recent []Reminder
+	_, err = datastore.NewQuery("Reminder").Filter("SentTime >", cutoff).GetAll(c, &recent)
+	if err != nil {
+		return "", fmt.Errorf("failed to load recent reminders: %v", err)
+	}
+	for _, r := range recent {
+		used[r.Prompt] = true
+	}
+
+	fresh := []string{}
+	for _, p := range candidates {
+		if !used[p] {
+			fresh = append(fresh, p)
+		}
+	}
+	if len(fresh) == 0 {
+		c.Infof("all %v prompts used in the last %v days, allowing repeats",
+			len(candidates), settings.Window)
+		fresh = candidates
+	}
+
+	return fresh[rand.Intn(len(fresh))], nil
+}
+
+func hasCommonTheme(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if strings.EqualFold(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func saveReminder(c appengine.Context, r Reminder) error {
+	key := datastore.NewKey(c, "Reminder", r.Tag, 0, nil)
+	if _, err := datastore.Put(c, key, &r); err != nil {
+		return fmt.Errorf("failed to save reminder: %v", err)
+	}
+	return nil
+}
+
+// getReminderPrompt returns the prompt sent along with the reminder a reply
+// quotes, or "" if the reminder is unknown.
+func getReminderPrompt(c appengine.Context, text string) string {
+	tag, err := findReminderTag(text)
+	if err != nil {
+		return ""
+	}
+
+	var r Reminder
+	err = datastore.Get(c, datastore.NewKey(c, "Reminder", tag, 0, nil), &r)
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			c.Errorf("failed to fetch reminder '%v': %v", tag, err)
+		}
+		return ""
+	}
+	return r.Prompt
+}
+
+func splitThemes(raw string) []string {
+	themes := []string{}
+	for _, theme := range strings.Split(raw, ",") {
+		theme = strings.ToLower(strings.TrimSpace(theme))
+		if theme != "" {
+			themes = append(themes, theme)
+		}
+	}
+	return themes
+}
+
+var whitespaceRegexp = regexp.MustCompile(`\s+`)
+
+func showPrompts(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	settings, err := loadPromptSettings(c)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	prompts, keys, err := loadPrompts(c)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	content := PromptsContent{
+		Window: settings.Window,
+		Themes: strings.Join(settings.Themes, ", "),
+	}
+	for i, p := range prompts {
+		item := PromptContent{
+			Text:   p.Text,
+			Themes: strings.Join(p.Themes, ", "),
+		}
+		if keys[i] != nil {
+			item.Key = keys[i].Encode()
+		}
+		content.Prompts = append(content.Prompts, item)
+	}
+
+	renderPage(c, w, promptsTemplate, "Prompts", content)
+}
+
+func addPrompt(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	text := strings.TrimSpace(whitespaceRegexp.ReplaceAllString(r.FormValue("text"), " "))
+	// entries are listed by their prompt, so it has to stay indexable
+	text = truncateIndexed(text)
+	if text != "" {
+		p := Prompt{
+			Text:         text,
+			Themes:       splitThemes(r.FormValue("themes")),
+			CreationTime: time.Now(),
+		}
+		_, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Prompt", nil), &p)
+		if err != nil {
+			c.Errorf("failed to save prompt: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/prompts")
+	w.WriteHeader(http.StatusFound)
+}
+
+func deletePrompt(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	rawKey := r.FormValue("key")
+	key, err := datastore.DecodeKey(rawKey)
+	if err != nil || key.Kind() != "Prompt" {
+		c.Errorf("Failed to parse decode key '%v': %v", rawKey, err)
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+
+	if err = datastore.Delete(c, key); err != nil {
+		c.Errorf("failed to delete prompt: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/prompts")
+	w.WriteHeader(http.StatusFound)
+}
+
+func savePromptSettings(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	window, err := strconv.Atoi(r.FormValue("window"))
+	if err != nil || window < 0 {
+		http.Error(w, "window has to be a non-negative number of days", http.StatusBadRequest)
+		return
+	}
+
+	s := PromptSettings{
+		Window: window,
+		Themes: splitThemes(r.FormValue("themes")),
+	}
+	if _, err = datastore.Put(c, promptSettingsKey(c), &s); err != nil {
+		c.Errorf("failed to save prompt settings: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/prompts")
+	w.WriteHeader(http.StatusFound)
+}
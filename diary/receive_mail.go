@@ -57,6 +57,8 @@ func incomingMail(w http.ResponseWriter, r *http.Request) {
 
 	c.Infof("Received mail from %s: %s", m.From, body)
 
+	mood, energy, body := parseScores(body)
+
 	date, err := getReminderDate(c, rawBody)
 	if err != nil {
 		c.Errorf("error while parsing date: %v", err)
@@ -70,14 +72,21 @@ func incomingMail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	e := DiaryEntry{
-		Author:       "Julian",
-		Content:      []byte(body),
+		Author:       diaryAuthor,
 		Date:         date,
 		CreationTime: time.Now(),
 		Attachments:  attachments,
+		Prompt:       getReminderPrompt(c, rawBody),
+		Mood:         mood,
+		Energy:       energy,
+		Sections: []Section{{
+			Text:         []byte(body),
+			Source:       sourceMail,
+			CreationTime: time.Now(),
+		}},
 	}
 
-	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "DiaryEntry", nil), &e)
+	_, err = saveEntry(c, datastore.NewIncompleteKey(c, "DiaryEntry", nil), &e, sourceMail, nil)
 	if err != nil {
 		c.Errorf("Failed to save to datastore: %s", err.Error())
 		return
@@ -114,6 +123,8 @@ func parseMail(w http.ResponseWriter, r *http.Request) {
 
 	c.Infof("Received mail from %v: %v", parsedMail.Headers["From"], cleanBody)
 
+	mood, energy, cleanBody := parseScores(cleanBody)
+
 	date, err := getReminderDate(c, rawBody)
 	if err != nil {
 		c.Errorf("error while parsing date: %v", err)
@@ -127,14 +138,21 @@ func parseMail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	e := DiaryEntry{
-		Author:       "Julian",
-		Content:      []byte(cleanBody),
+		Author:       diaryAuthor,
 		Date:         date,
 		CreationTime: time.Now(),
 		Attachments:  attachments,
+		Prompt:       getReminderPrompt(c, rawBody),
+		Mood:         mood,
+		Energy:       energy,
+		Sections: []Section{{
+			Text:         []byte(cleanBody),
+			Source:       sourceMail,
+			CreationTime: time.Now(),
+		}},
 	}
 
-	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "DiaryEntry", nil), &e)
+	_, err = saveEntry(c, datastore.NewIncompleteKey(c, "DiaryEntry", nil), &e, sourceMail, nil)
 	if err != nil {
 		c.Errorf("Failed to save to datastore: %s", err.Error())
 		return
@@ -177,16 +195,25 @@ func getMailBody(reply string) (string, error) {
 	return strings.Trim(cleanText, " \n"), nil
 }
 
-func getReminderDate(c appengine.Context, text string) (time.Time, error) {
+// findReminderTag extracts the tag of the reminder quoted in a reply.
+func findReminderTag(text string) (string, error) {
 	re, err := regexp.Compile(`diaryentry\d+tag`)
 	if err != nil {
-		return time.Now(), fmt.Errorf("Failed to compile regex: %v", err)
+		return "", fmt.Errorf("Failed to compile regex: %v", err)
 	}
 
 	tag := re.FindString(text)
 
 	if tag == "" {
-		return time.Now(), fmt.Errorf("Failed to match tag")
+		return "", fmt.Errorf("Failed to match tag")
+	}
+	return tag, nil
+}
+
+func getReminderDate(c appengine.Context, text string) (time.Time, error) {
+	tag, err := findReminderTag(text)
+	if err != nil {
+		return time.Now(), err
 	}
 
 	item, err := memcache.Get(c, tag)
@@ -210,7 +237,7 @@ func storeAttachments(c appengine.Context, rawAttachments []AttachmentJSON) ([]*
 	for _, rawAttachment := range rawAttachments {
 		bytes, err := base64.StdEncoding.DecodeString(rawAttachment.Content)
 		if err != nil {
-			return nil, fmt.Errorf("failed to decode attachment '%v':",
+			return nil, fmt.Errorf("failed to decode attachment '%v': %v",
 				rawAttachment.Name, err)
 		}
 
@@ -232,6 +259,29 @@ func storeAttachments(c appengine.Context, rawAttachments []AttachmentJSON) ([]*
 			return nil, fmt.Errorf("failed to get key for blobstore entry: %v", err)
 		}
 
+		key, err := saveAttachment(c, blobKey, rawAttachment.Name, rawAttachment.ContentType)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// saveAttachment creates the Attachment record for a blob, including serving
+// URLs for images.
+func saveAttachment(c appengine.Context, blobKey appengine.BlobKey, name, contentType string) (*datastore.Key, error) {
+	e := Attachment{
+		Name:         name,
+		Content:      blobKey,
+		ContentType:  contentType,
+		CreationTime: time.Now(),
+	}
+
+	// the image service only serves images
+	if strings.HasPrefix(contentType, "image/") {
 		thumbnailURL, err := image.ServingURL(c, blobKey, &image.ServingURLOptions{
 			Secure: true,
 			Size:   400,
@@ -250,24 +300,15 @@ func storeAttachments(c appengine.Context, rawAttachments []AttachmentJSON) ([]*
 			return nil, fmt.Errorf("failed to create big image: %v", err)
 		}
 
-		e := Attachment{
-			Name:         rawAttachment.Name,
-			Content:      blobKey,
-			ContentType:  rawAttachment.ContentType,
-			CreationTime: time.Now(),
-			Thumbnail:    thumbnailURL.String(),
-			BigImage:     bigImageURL.String(),
-		}
-
-		key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Attachment", nil), &e)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to save to datastore: %s", err)
-		}
-
-		keys = append(keys, key)
+		e.Thumbnail = thumbnailURL.String()
+		e.BigImage = bigImageURL.String()
 	}
 
-	return keys, nil
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Attachment", nil), &e)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to save to datastore: %s", err)
+	}
+	return key, nil
 }
 
 func FindStringNthSubmatch(s string, regex string, n int) (string, error) {
@@ -0,0 +1,137 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ReminderTemplate holds the user-editable templates used to render the
+// reminder mail. Empty fields fall back to the built-in defaults.
+type ReminderTemplate struct {
+	Subject string
+	Text    []byte
+	HTML    []byte
+}
+
+// ReminderContent is passed to all reminder templates.
+type ReminderContent struct {
+	Date   time.Time
+	Tag    string
+	Prompt string
+	// open todos of earlier entries, oldest first
+	Todos []string
+	// days in a row with an entry, up to yesterday
+	Streak int
+	// set for the late reminder, sent when the streak is about to break
+	Late bool
+}
+
+const defaultReminderSubject = `{{if .Late}}You're about to break a {{.Streak}}-day streak{{else}}Entry reminder{{end}}`
+
+const defaultReminderText = `
+Don't forget to update your diary!
+
+Just respond to this message with todays entry.
+{{if .Late}}
+You're about to break a {{.Streak}}-day streak, there's still time to keep it going.
+{{else}}{{if .Streak}}
+You have written {{.Streak}} days in a row.
+{{end}}{{end}}{{if .Prompt}}
+Question of the day: {{.Prompt}}
+{{end}}{{if .Todos}}
+Still open:
+{{range .Todos}}  * {{.}}
+{{end}}{{end}}
+
+-----
+{{.Tag}}
+`
+
+// the tag is styled to be invisible, but it still ends up in the quoted text
+// of a reply, which is where getReminderDate looks for it
+const defaultReminderHTML = `
+<p>Don't forget to update your diary!</p>
+<p>Just respond to this message with todays entry.</p>
+{{if .Late}}<p><b>You're about to break a {{.Streak}}-day streak</b>, there's still time to keep it going.</p>
+{{else}}{{if .Streak}}<p>You have written {{.Streak}} days in a row.</p>{{end}}{{end}}
+{{if .Prompt}}<p><i>Question of the day:</i> {{.Prompt}}</p>{{end}}
+{{if .Todos}}<p><i>Still open:</i></p><ul>{{range .Todos}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<p style="color:#ffffff;font-size:1px;line-height:1px">{{.Tag}}</p>
+`
+
+func reminderTemplateKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "ReminderTemplate", "default", 0, nil)
+}
+
+func loadReminderTemplate(c appengine.Context) (ReminderTemplate, error) {
+	var t ReminderTemplate
+	err := datastore.Get(c, reminderTemplateKey(c), &t)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return ReminderTemplate{}, fmt.Errorf("failed to load reminder template: %v", err)
+	}
+
+	if t.Subject == "" {
+		t.Subject = defaultReminderSubject
+	}
+	if len(t.Text) == 0 {
+		t.Text = []byte(defaultReminderText)
+	}
+	if len(t.HTML) == 0 {
+		t.HTML = []byte(defaultReminderHTML)
+	}
+	return t, nil
+}
+
+func saveReminderTemplate(c appengine.Context, t ReminderTemplate) error {
+	_, err := datastore.Put(c, reminderTemplateKey(c), &t)
+	if err != nil {
+		return fmt.Errorf("failed to save reminder template: %v", err)
+	}
+	return nil
+}
+
+// renderReminder executes all three templates. Should a user template drop the
+// tag, it is appended again - without it replies can't be matched to a date.
+func renderReminder(t ReminderTemplate, content ReminderContent) (subject, text, html string, err error) {
+	subjectTmpl, err := template.New("subject").Parse(t.Subject)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to parse subject template: %v", err)
+	}
+	textTmpl, err := template.New("text").Parse(string(t.Text))
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to parse text template: %v", err)
+	}
+	htmlTmpl, err := htmltemplate.New("html").Parse(string(t.HTML))
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to parse html template: %v", err)
+	}
+
+	var subjectBuf, textBuf, htmlBuf bytes.Buffer
+	if err = subjectTmpl.Execute(&subjectBuf, content); err != nil {
+		return "", "", "", fmt.Errorf("failed to render subject: %v", err)
+	}
+	if err = textTmpl.Execute(&textBuf, content); err != nil {
+		return "", "", "", fmt.Errorf("failed to render text: %v", err)
+	}
+	if err = htmlTmpl.Execute(&htmlBuf, content); err != nil {
+		return "", "", "", fmt.Errorf("failed to render html: %v", err)
+	}
+
+	text = textBuf.String()
+	if !strings.Contains(text, content.Tag) {
+		text += "\n\n-----\n" + content.Tag + "\n"
+	}
+	html = htmlBuf.String()
+	if !strings.Contains(html, content.Tag) {
+		html += fmt.Sprintf(`<p style="color:#ffffff;font-size:1px;line-height:1px">%v</p>`,
+			htmltemplate.HTMLEscapeString(content.Tag))
+	}
+
+	return strings.TrimSpace(subjectBuf.String()), text, html, nil
+}
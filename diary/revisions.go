@@ -0,0 +1,189 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// where a change to an entry came from
+const (
+	sourceMail = "mail"
+	sourceWeb  = "web"
+	// content of entries written before revisions were recorded
+	sourceOriginal = "original"
+)
+
+// Revision is the full content of an entry after one change. Revisions are
+// stored as children of their DiaryEntry, diffs are computed when shown.
+type Revision struct {
+	Content      []byte
+	Sections     []Section
+	Source       string
+	CreationTime time.Time
+}
+
+// errEntryChanged is returned by changes that don't fit the entry anymore,
+// because it was changed since the form was loaded.
+var errEntryChanged = errors.New("the entry changed, please reload and try again")
+
+// saveEntry stores an entry and records its content as a new revision. key
+// may be incomplete for new entries; the complete key is returned. Existing
+// entries are changed by change instead, which gets e as read again in the
+// transaction, so that nothing saved since it was shown is lost.
+func saveEntry(c appengine.Context, key *datastore.Key, e *DiaryEntry, source string, change func(*DiaryEntry) error) (*datastore.Key, error) {
+	settings, err := loadEntrySettings(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved *datastore.Key
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if change != nil {
+			// loading appends to the slices of e, and transactions may retry
+			*e = DiaryEntry{}
+			if err := datastore.Get(c, key, e); err != nil {
+				return fmt.Errorf("failed to fetch entry: %v", err)
+			}
+			if err := change(e); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		saved, err = putRevision(c, key, e, source, settings)
+		return err
+	}, nil)
+	return saved, err
+}
+
+// putRevision is saveEntry for callers that already run a transaction.
+func putRevision(c appengine.Context, key *datastore.Key, e *DiaryEntry, source string, settings entrySettings) (*datastore.Key, error) {
+	e.Sections = entrySections(*e)
+	e.Content = joinSections(e.Sections)
+
+	if !key.Incomplete() {
+		if err := recordOriginal(c, key); err != nil {
+			return nil, err
+		}
+	}
+
+	saved, err := putEntry(c, key, e, settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save entry: %v", err)
+	}
+
+	r := Revision{
+		Content:      e.Content,
+		Sections:     e.Sections,
+		Source:       source,
+		CreationTime: time.Now(),
+	}
+	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Revision", saved), &r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save revision: %v", err)
+	}
+	return saved, nil
+}
+
+// recordOriginal stores the current content of an entry that has no
+// revisions yet, so the first edit doesn't lose it.
+func recordOriginal(c appengine.Context, key *datastore.Key) error {
+	count, err := datastore.NewQuery("Revision").Ancestor(key).KeysOnly().Limit(1).Count(c)
+	if err != nil {
+		return fmt.Errorf("failed to count revisions: %v", err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	var old DiaryEntry
+	if err := datastore.Get(c, key, &old); err != nil {
+		return fmt.Errorf("failed to fetch entry: %v", err)
+	}
+
+	r := Revision{
+		Content:      old.Content,
+		Sections:     entrySections(old),
+		Source:       sourceOriginal,
+		CreationTime: old.CreationTime,
+	}
+	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Revision", key), &r)
+	if err != nil {
+		return fmt.Errorf("failed to save original revision: %v", err)
+	}
+	return nil
+}
+
+// loadRevisions returns all revisions of an entry, oldest first.
+func loadRevisions(c appengine.Context, key *datastore.Key) ([]*datastore.Key, []Revision, error) {
+	var revisions []Revision
+	keys, err := datastore.NewQuery("Revision").Ancestor(key).Order("CreationTime").GetAll(c, &revisions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load revisions: %v", err)
+	}
+	return keys, revisions, nil
+}
+
+// DiffLine is one line of a line based diff between two revisions.
+type DiffLine struct {
+	// "same", "added" or "removed"
+	Kind string
+	Text string
+}
+
+// diffLines computes a line diff from a to b using the longest common
+// subsequence. Entries are short, so the quadratic table is fine.
+func diffLines(a, b []byte) []DiffLine {
+	x := splitLines(a)
+	y := splitLines(b)
+
+	// lcs[i][j] is the length of the LCS of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := []DiffLine{}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			diff = append(diff, DiffLine{Kind: "same", Text: x[i]})
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, DiffLine{Kind: "removed", Text: x[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{Kind: "added", Text: y[j]})
+			j++
+		}
+	}
+	return diff
+}
+
+func splitLines(text []byte) []string {
+	lines := []string{}
+	if len(text) == 0 {
+		return lines
+	}
+	for _, line := range bytes.Split(text, []byte{'\n'}) {
+		lines = append(lines, string(line))
+	}
+	return lines
+}
@@ -0,0 +1,36 @@
+package diary
+
+// Entries are stored as plain text and parsed into the structures below for
+// rendering. They only carry structure and text - the templates escape all of
+// it, so nothing written in an entry ends up in a page as markup.
+
+// Block is a block level element of an entry.
+type Block struct {
+	// "paragraph", "heading", "list", "quote", "code" or "rule"
+	Kind string
+	// heading level, starting at 1
+	Level int
+	// whether a list is numbered
+	Ordered bool
+	// content of paragraphs, headings and quotes
+	Inlines []Inline
+	Items   []ListItem
+	// content of code blocks, rendered as is
+	Text string
+}
+
+// ListItem is a single item of a list, optionally with a checkbox.
+type ListItem struct {
+	Checkbox bool
+	Checked  bool
+	Inlines  []Inline
+}
+
+// Inline is a run of text within a block.
+type Inline struct {
+	// "text", "strong", "emphasis", "code", "link" or "break"
+	Kind string
+	Text string
+	// target of links, only http(s), mailto and local links are kept
+	URL string
+}
@@ -0,0 +1,518 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SearchIndex holds the stemmed terms of one entry and is stored as its
+// child. Looking up entries containing all terms of a query is a merge join
+// over the index of Terms and Date, which also returns them newest first.
+type SearchIndex struct {
+	Terms []string
+	// of the entry
+	Date time.Time
+}
+
+// SearchResult is one entry matching a query, as shown on the search page and
+// returned by the search API.
+type SearchResult struct {
+	Key     string        `json:"key"`
+	Day     string        `json:"day"`
+	Date    time.Time     `json:"date"`
+	Snippet []SnippetPart `json:"snippet"`
+}
+
+type SnippetPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+const (
+	// at most this many results are returned per query
+	searchResultLimit = 100
+	// entries fetched at a time while looking for results
+	searchBatchSize = 50
+	// words shown around the first match
+	snippetBefore = 10
+	snippetAfter  = 25
+)
+
+// entrySettings are the settings putEntry derives tags, people and fields
+// with.
+// They are global entities, so they are loaded before the transaction saving
+// an entry; reading them inside would pull their entity groups into it.
+type entrySettings struct {
+	extractors []extractor
+	aliases    aliases
+	schemas    []FieldSchema
+}
+
+func loadEntrySettings(c appengine.Context) (entrySettings, error) {
+	extractors, err := loadExtractors(c)
+	if err != nil {
+		return entrySettings{}, err
+	}
+	p, err := loadPeopleSettings(c)
+	if err != nil {
+		return entrySettings{}, err
+	}
+	a, err := parseAliases(p.Aliases)
+	if err != nil {
+		// only valid lists are saved, so this doesn't happen
+		return entrySettings{}, err
+	}
+	schemas, err := loadFieldSchemas(c)
+	if err != nil {
+		return entrySettings{}, err
+	}
+	return entrySettings{extractors: extractors, aliases: a, schemas: schemas}, nil
+}
+
+func searchIndexKey(c appengine.Context, entryKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "SearchIndex", "", 1, entryKey)
+}
+
+// putEntry stores an entry together with everything derived from its content,
+// some of it right away and the rest in tasks enqueued with the write. Every
+// write of a DiaryEntry has to go through here, so that nothing derived from
+// an entry gets out of date.
+func putEntry(c appengine.Context, key *datastore.Key, e *DiaryEntry, settings entrySettings) (*datastore.Key, error) {
+	e.Tags = tagNames(extractTags(settings.extractors, e.Content))
+	e.People = findPeople(settings.aliases, e.Content, e.Tags)
+	e.Fields = parseFields(e.Content, settings.schemas)
+
+	key, err := datastore.Put(c, key, e)
+	if err != nil {
+		return nil, err
+	}
+	index := SearchIndex{Terms: indexTerms(string(e.Content)), Date: e.Date}
+	if _, err = datastore.Put(c, searchIndexKey(c, key), &index); err != nil {
+		return nil, fmt.Errorf("failed to update search index: %v", err)
+	}
+	if err = putTodos(c, key, extractTodos(e.Content, e.Date)); err != nil {
+		return nil, err
+	}
+	syncIdeasLater.Call(c, key)
+	updateStreakLater.Call(c, key)
+	if len(e.Attachments) > 0 {
+		linkAttachmentsLater.Call(c, key)
+	}
+	return key, nil
+}
+
+// removeEntry deletes an entry, its search index, its todos and its ideas.
+func removeEntry(c appengine.Context, key *datastore.Key) error {
+	if err := datastore.DeleteMulti(c, []*datastore.Key{key, searchIndexKey(c, key)}); err != nil {
+		return err
+	}
+	if err := deleteTodos(c, key); err != nil {
+		return err
+	}
+	syncIdeasLater.Call(c, key)
+	return nil
+}
+
+// token is a word of a text, Start and End are byte offsets into the text.
+type token struct {
+	Stem       string
+	Start, End int
+}
+
+func tokenize(text string) []token {
+	tokens := []token{}
+	start := -1
+	for i, r := range text + " " {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if inWord && start < 0 {
+			start = i
+		} else if !inWord && start >= 0 {
+			tokens = append(tokens, token{
+				Stem:  stem(normalizeWord(text[start:i])),
+				Start: start,
+				End:   i,
+			})
+			start = -1
+		}
+	}
+	return tokens
+}
+
+var umlautReplacer = strings.NewReplacer("ä", "a", "ö", "o", "ü", "u", "ß", "ss")
+
+func normalizeWord(word string) string {
+	return umlautReplacer.Replace(strings.ToLower(word))
+}
+
+// stem is a light stemmer for both German and English, as entries mix the
+// two. It strips common inflections like CISTEM does for German; it is
+// aggressive, but as queries are stemmed the same way that rarely matters.
+func stem(word string) string {
+	length := utf8.RuneCountInString(word)
+
+	switch {
+	case length > 4 && strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-3] + "y"
+	case length > 5 && strings.HasSuffix(word, "ing"):
+		word = word[:len(word)-3]
+	case length > 4 && strings.HasSuffix(word, "ed"):
+		word = word[:len(word)-2]
+	}
+
+	for utf8.RuneCountInString(word) > 3 {
+		switch {
+		case utf8.RuneCountInString(word) > 5 && (strings.HasSuffix(word, "em") ||
+			strings.HasSuffix(word, "er") || strings.HasSuffix(word, "nd")):
+			word = word[:len(word)-2]
+		case strings.HasSuffix(word, "e") || strings.HasSuffix(word, "s") ||
+			strings.HasSuffix(word, "n") || strings.HasSuffix(word, "t"):
+			word = word[:len(word)-1]
+		default:
+			return word
+		}
+	}
+	return word
+}
+
+// too common to be worth indexing, they still count in phrases
+var stopWords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`a an and are as at be but by for from had has have i in is it
+		me my of on or so that the to was we were with
+		auf aus bei bin das dass dem den der des die du ein eine einem einen einer er es
+		hat ich im in ist mich mir mit nicht noch oder sich sie und von war wir zu zum zur`) {
+		stopWords[stem(w)] = true
+	}
+}
+
+// indexTerms returns the distinct stems of text that are worth indexing.
+func indexTerms(text string) []string {
+	seen := map[string]bool{}
+	terms := []string{}
+	for _, t := range tokenize(text) {
+		if !stopWords[t.Stem] && !seen[t.Stem] {
+			seen[t.Stem] = true
+			terms = append(terms, t.Stem)
+		}
+	}
+	return terms
+}
+
+// searchQuery is a parsed query. Words in double quotes form a phrase, which
+// only matches if its words appear in order.
+type searchQuery struct {
+	Terms   []string
+	Phrases [][]string
+}
+
+func parseQuery(q string) searchQuery {
+	query := searchQuery{}
+	seen := map[string]bool{}
+	for i, part := range strings.Split(q, `"`) {
+		stems := []string{}
+		for _, t := range tokenize(part) {
+			stems = append(stems, t.Stem)
+			if !stopWords[t.Stem] && !seen[t.Stem] {
+				seen[t.Stem] = true
+				query.Terms = append(query.Terms, t.Stem)
+			}
+		}
+		// odd parts are inside quotes
+		if i%2 == 1 && len(stems) > 1 {
+			query.Phrases = append(query.Phrases, stems)
+		}
+	}
+	return query
+}
+
+// matches checks the phrases of the query against the tokens of an entry.
+// The terms already matched through the index.
+func (q searchQuery) matches(tokens []token) bool {
+	for _, phrase := range q.Phrases {
+		if phraseStart(tokens, phrase) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func phraseStart(tokens []token, phrase []string) int {
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		found := true
+		for j, s := range phrase {
+			if tokens[i+j].Stem != s {
+				found = false
+				break
+			}
+		}
+		if found {
+			return i
+		}
+	}
+	return -1
+}
+
+// snippet returns the text around the first match with all matching words
+// marked.
+func (q searchQuery) snippet(text string, tokens []token) []SnippetPart {
+	terms := map[string]bool{}
+	for _, t := range q.Terms {
+		terms[t] = true
+	}
+
+	first := 0
+	if len(q.Phrases) > 0 {
+		first = phraseStart(tokens, q.Phrases[0])
+	} else {
+		for i, t := range tokens {
+			if terms[t.Stem] {
+				first = i
+				break
+			}
+		}
+	}
+
+	from := first - snippetBefore
+	if from < 0 {
+		from = 0
+	}
+	to := first + snippetAfter
+	if to > len(tokens) {
+		to = len(tokens)
+	}
+	if from >= to {
+		return []SnippetPart{}
+	}
+
+	parts := []SnippetPart{}
+	if from > 0 {
+		parts = append(parts, SnippetPart{Text: "… "})
+	}
+	offset := tokens[from].Start
+	for _, t := range tokens[from:to] {
+		if !terms[t.Stem] {
+			continue
+		}
+		parts = append(parts,
+			SnippetPart{Text: text[offset:t.Start]},
+			SnippetPart{Text: text[t.Start:t.End], Match: true})
+		offset = t.End
+	}
+	parts = append(parts, SnippetPart{Text: text[offset:tokens[to-1].End]})
+	if to < len(tokens) {
+		parts = append(parts, SnippetPart{Text: " …"})
+	}
+	return parts
+}
+
+// search returns the entries matching q between from and to (both inclusive
+// and optional), newest first.
+func search(c appengine.Context, q string, from, to time.Time, loc *time.Location) ([]SearchResult, error) {
+	query := parseQuery(q)
+	results := []SearchResult{}
+	if len(query.Terms) == 0 {
+		return results, nil
+	}
+
+	dq := datastore.NewQuery("SearchIndex").KeysOnly().Order("-Date")
+	for _, t := range query.Terms {
+		dq = dq.Filter("Terms =", t)
+	}
+
+	// the index is read newest first, a batch of entries at a time, until
+	// enough of them matched or the date range is passed
+	it := dq.Run(c)
+	for done := false; !done && len(results) < searchResultLimit; {
+		keys := []*datastore.Key{}
+		for len(keys) < searchBatchSize {
+			k, err := it.Next(nil)
+			if err == datastore.Done {
+				done = true
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to query search index: %v", err)
+			}
+			keys = append(keys, k.Parent())
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		entries := make([]DiaryEntry, len(keys))
+		err := datastore.GetMulti(c, keys, entries)
+		errs, partial := err.(appengine.MultiError)
+		if err != nil && !partial {
+			return nil, fmt.Errorf("failed to fetch entries: %v", err)
+		}
+
+		for i, e := range entries {
+			if partial && errs[i] != nil {
+				// a stale index of a deleted entry
+				continue
+			}
+			date := e.Date.In(loc)
+			if !from.IsZero() && date.Before(from) {
+				done = true
+				break
+			}
+			if !to.IsZero() && !date.Before(to.AddDate(0, 0, 1)) {
+				continue
+			}
+
+			text := string(e.Content)
+			tokens := tokenize(text)
+			if !query.matches(tokens) {
+				continue
+			}
+
+			results = append(results, SearchResult{
+				Key:     keys[i].Encode(),
+				Day:     date.Format(dateFormat),
+				Date:    date,
+				Snippet: query.snippet(text, tokens),
+			})
+			if len(results) == searchResultLimit {
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+// parseSearchDates reads the optional "from" and "to" form values.
+func parseSearchDates(r *http.Request, loc *time.Location) (from, to time.Time, err error) {
+	if raw := r.FormValue("from"); raw != "" {
+		if from, err = time.ParseInLocation(dateFormat, raw, loc); err != nil {
+			return from, to, fmt.Errorf("invalid from date '%v'", raw)
+		}
+	}
+	if raw := r.FormValue("to"); raw != "" {
+		if to, err = time.ParseInLocation(dateFormat, raw, loc); err != nil {
+			return from, to, fmt.Errorf("invalid to date '%v'", raw)
+		}
+	}
+	return from, to, nil
+}
+
+func showSearch(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	content := SearchContent{
+		Query:   r.FormValue("q"),
+		From:    r.FormValue("from"),
+		To:      r.FormValue("to"),
+		Results: []SearchResult{},
+	}
+
+	from, to, err := parseSearchDates(r, loc)
+	if err != nil {
+		content.Error = err.Error()
+	} else if content.Query != "" {
+		content.Results, err = search(c, content.Query, from, to, loc)
+		if err != nil {
+			c.Errorf("%v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		content.Searched = true
+	}
+
+	renderPage(c, w, searchTemplate, "Search", content)
+}
+
+// searchAPI is the JSON version of the search page.
+func searchAPI(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	from, to, err := parseSearchDates(r, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, err := search(c, r.FormValue("q"), from, to, loc)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err = json.NewEncoder(w).Encode(results); err != nil {
+		c.Errorf("failed to encode search results: %v", err)
+	}
+}
+
+// reindexEntries updates the tags and search index of all entries. It has to
+// run once for entries written before they existed or before the index held
+// their date, and after the extractors change.
+func reindexEntries(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	reindexEntriesLater.Call(c, "")
+	fmt.Fprint(w, "Reindexing entries in the background")
+}
+
+// reindexEntriesLater calls itself with the next cursor, so it's set in init
+var reindexEntriesLater *delay.Function
+
+func init() {
+	reindexEntriesLater = delay.Func("reindexEntries", reindexEntryBatch)
+}
+
+func reindexEntryBatch(c appengine.Context, cursor string) error {
+	settings, err := loadEntrySettings(c)
+	if err != nil {
+		return err
+	}
+
+	indexed := 0
+	next, err := migrateEntries(c, cursor, func(key *datastore.Key, e *DiaryEntry) error {
+		indexed++
+		_, err := putEntry(c, key, e, settings)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.Infof("Indexed %v entries", indexed)
+
+	if next != "" {
+		reindexEntriesLater.Call(c, next)
+	}
+	return nil
+}
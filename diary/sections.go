@@ -0,0 +1,135 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Section is one part of an entry: the reply that created it, or a later
+// addition. Sections only hold text, rendering adds the presentation.
+type Section struct {
+	Text         []byte
+	Source       string
+	CreationTime time.Time
+}
+
+// entrySections returns the sections of an entry. For entries saved before
+// sections existed they are split from the content, see splitLegacyContent.
+func entrySections(e DiaryEntry) []Section {
+	if len(e.Sections) > 0 {
+		return e.Sections
+	}
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	return splitLegacyContent(e, loc)
+}
+
+// joinSections builds the plain text of an entry, which is kept in
+// DiaryEntry.Content for everything that only cares about the text.
+func joinSections(sections []Section) []byte {
+	texts := [][]byte{}
+	for _, s := range sections {
+		texts = append(texts, bytes.TrimSpace(s.Text))
+	}
+	return bytes.Join(texts, []byte("\n\n"))
+}
+
+// appends used to be spliced into the content like this
+var legacyAppendRegexp = regexp.MustCompile(`\s*<b>extended on ([^<]+)</b>\s*`)
+
+const legacyAppendFormat = "Monday, 2. Jan - 15:04"
+
+// splitLegacyContent turns content with "extended on" markers into sections.
+// The markers have no year, so it is taken from the entry and bumped if the
+// append happened after new year.
+func splitLegacyContent(e DiaryEntry, loc *time.Location) []Section {
+	sections := []Section{}
+	markers := legacyAppendRegexp.FindAllSubmatchIndex(e.Content, -1)
+
+	start := 0
+	creationTime := e.CreationTime
+	source := sourceMail
+	for _, m := range markers {
+		sections = append(sections, Section{
+			Text:         e.Content[start:m[0]],
+			Source:       source,
+			CreationTime: creationTime,
+		})
+
+		created := e.Date.In(loc)
+		t, err := time.ParseInLocation(legacyAppendFormat, string(e.Content[m[2]:m[3]]), loc)
+		if err == nil {
+			created = time.Date(created.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+			if created.Before(e.Date) {
+				created = created.AddDate(1, 0, 0)
+			}
+		}
+
+		start = m[1]
+		creationTime = created
+		source = sourceWeb
+	}
+	sections = append(sections, Section{
+		Text:         e.Content[start:],
+		Source:       source,
+		CreationTime: creationTime,
+	})
+
+	return sections
+}
+
+// migrateSections is a one-off task storing DiaryEntry.Sections for entries
+// written before sections existed.
+func migrateSections(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	migrateSectionsLater.Call(c, "")
+	fmt.Fprint(w, "Migrating entries in the background")
+}
+
+// migrateSectionsLater calls itself with the next cursor, so it's set in init
+var migrateSectionsLater *delay.Function
+
+func init() {
+	migrateSectionsLater = delay.Func("migrateSections", migrateSectionBatch)
+}
+
+func migrateSectionBatch(c appengine.Context, cursor string) error {
+	settings, err := loadEntrySettings(c)
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	next, err := migrateEntries(c, cursor, func(key *datastore.Key, e *DiaryEntry) error {
+		if len(e.Sections) > 0 {
+			return nil
+		}
+		e.Sections = entrySections(*e)
+		e.Content = joinSections(e.Sections)
+		migrated++
+		_, err := putEntry(c, key, e, settings)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.Infof("Migrated %v entries", migrated)
+
+	if next != "" {
+		migrateSectionsLater.Call(c, next)
+	}
+	return nil
+}
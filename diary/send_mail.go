@@ -2,7 +2,6 @@ package diary
 
 import (
 	"appengine"
-	"appengine/datastore"
 	"appengine/mail"
 	"appengine/memcache"
 	"fmt"
@@ -14,7 +13,7 @@ import (
 func checkReminder(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
-	loc, err := time.LoadLocation("Europe/Vienna")
+	loc, err := time.LoadLocation(diaryTimezone)
 	if err != nil {
 		c.Errorf("Failed to load timezone")
 		return
@@ -24,23 +23,57 @@ func checkReminder(w http.ResponseWriter, r *http.Request) {
 	y, m, d := now.Date()
 	cutoff := time.Date(y, m, d, 0, 0, 0, 0, loc)
 
-	q := datastore.NewQuery("DiaryEntry").Filter("Date >", cutoff)
-	t := q.Run(c)
-	var e DiaryEntry
-	_, err = t.Next(&e)
-
-	if err == datastore.Done {
-		// no entry yet for today - send reminder
-		fmt.Fprintf(w, "Sending reminder email")
-		sendReminder(c, cutoff)
-	} else {
+	written, err := entriesBetween(cutoff, cutoff.AddDate(0, 0, 1)).KeysOnly().Limit(1).Count(c)
+	if err != nil {
+		c.Errorf("failed to look for today's entry: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if written > 0 {
 		fmt.Fprintf(w, "I already have an entry for today")
+		return
+	}
+
+	streak, err := loadStreak(c, diaryAuthor)
+	if err != nil {
+		// the reminder matters more than the streak
+		c.Errorf("%v", err)
+	}
+	current := streak.At(cutoff)
+
+	// the late reminder is only sent if there's a streak to lose
+	late := r.FormValue("late") != ""
+	if late && current < lateReminderStreak {
+		fmt.Fprintf(w, "No streak to keep going")
+		return
 	}
+
+	// no entry yet for today - send reminder
+	fmt.Fprintf(w, "Sending reminder email")
+	sendReminder(c, cutoff, current, late)
 }
 
-func sendReminder(c appengine.Context, date time.Time) {
-	addr := "j.schrittwieser@gmail.com"
+const (
+	mailSender    = "Automatic Diary <diary@furidamu.org>"
+	mailRecipient = "j.schrittwieser@gmail.com"
+)
+
+// sendMail sends a multipart/alternative mail to the diary owner.
+func sendMail(c appengine.Context, subject, text, html string) error {
+	msg := &mail.Message{
+		Sender:  mailSender,
+		To:      []string{mailRecipient},
+		Subject: subject,
+		Body:    text,
+		HTML:    html,
+	}
+	if err := mail.Send(c, msg); err != nil {
+		return fmt.Errorf("Couldn't send email: %v", err)
+	}
+	return nil
+}
 
+func sendReminder(c appengine.Context, date time.Time, streak int, late bool) {
 	tag := fmt.Sprintf("diaryentry%dtag", rand.Int63())
 
 	item := &memcache.Item{
@@ -55,26 +88,50 @@ func sendReminder(c appengine.Context, date time.Time) {
 		c.Errorf("error adding item: %v", err)
 	}
 
-	msg := &mail.Message{
-		Sender:  "Automatic Diary <diary@furidamu.org>",
-		To:      []string{addr},
-		Subject: "Entry reminder",
-		Body:    fmt.Sprintf(reminderMessage, tag),
-	}
-	if err := mail.Send(c, msg); err != nil {
-		c.Errorf("Couldn't send email: %v", err)
+	t, err := loadReminderTemplate(c)
+	if err != nil {
+		c.Errorf("%v", err)
 		return
 	}
-	c.Infof("Reminder mail sent for %v", date)
-	c.Infof("body: %v", msg.Body)
-}
 
-const reminderMessage = `
-Don't forget to update your diary!
+	prompt, err := choosePrompt(c, time.Now())
+	if err != nil {
+		// a reminder without a prompt is still better than none
+		c.Errorf("Couldn't choose prompt: %v", err)
+	}
 
-Just respond to this message with todays entry.
+	todos, err := openTodoTexts(c)
+	if err != nil {
+		c.Errorf("Couldn't load todos: %v", err)
+	}
 
+	subject, text, html, err := renderReminder(t, ReminderContent{
+		Date:   date,
+		Tag:    tag,
+		Prompt: prompt,
+		Todos:  todos,
+		Streak: streak,
+		Late:   late,
+	})
+	if err != nil {
+		c.Errorf("Couldn't render reminder: %v", err)
+		return
+	}
 
------
-%v
-`
+	if err := sendMail(c, subject, text, html); err != nil {
+		c.Errorf("%v", err)
+		return
+	}
+	c.Infof("Reminder mail sent for %v", date)
+
+	err = saveReminder(c, Reminder{
+		Tag:      tag,
+		Date:     date,
+		Prompt:   prompt,
+		SentTime: time.Now(),
+	})
+	if err != nil {
+		c.Errorf("%v", err)
+	}
+	c.Infof("body: %v", text)
+}
@@ -0,0 +1,89 @@
+package diary
+
+import (
+	"appengine"
+	"net/http"
+	"time"
+)
+
+func showReminderSettings(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	t, err := loadReminderTemplate(c)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderReminderSettings(c, w, t, "")
+}
+
+func saveReminderSettings(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	// storing empty templates makes loadReminderTemplate use the defaults
+	t := ReminderTemplate{}
+	if r.FormValue("reset") == "" {
+		t = ReminderTemplate{
+			Subject: r.FormValue("subject"),
+			Text:    []byte(r.FormValue("text")),
+			HTML:    []byte(r.FormValue("html")),
+		}
+
+		// refuse to store templates that would break the nightly reminder
+		_, _, _, err := renderReminder(t, ReminderContent{
+			Date:   time.Now(),
+			Tag:    "diaryentry0tag",
+			Prompt: builtinPrompts[0].Text,
+			Streak: 5,
+		})
+		if err != nil {
+			renderReminderSettings(c, w, t, err.Error())
+			return
+		}
+	}
+
+	if err := saveReminderTemplate(c, t); err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/settings/reminder")
+	w.WriteHeader(http.StatusFound)
+}
+
+func renderReminderSettings(c appengine.Context, w http.ResponseWriter, t ReminderTemplate, errMsg string) {
+	content := ReminderSettingsContent{
+		Subject:    t.Subject,
+		Text:       string(t.Text),
+		HTML:       string(t.HTML),
+		Error:      errMsg,
+		LateStreak: lateReminderStreak,
+	}
+
+	if errMsg == "" {
+		subject, text, _, err := renderReminder(t, ReminderContent{
+			Date:   time.Now(),
+			Tag:    "diaryentry0tag",
+			Prompt: builtinPrompts[0].Text,
+			Streak: 5,
+		})
+		if err != nil {
+			content.Error = err.Error()
+		} else {
+			content.Preview = "Subject: " + subject + "\n" + text
+		}
+	}
+
+	renderPage(c, w, reminderSettingsTemplate, "Reminder", content)
+}
@@ -0,0 +1,268 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Stats describe the writing habits over all entries. They are served as
+// JSON by /api/stats and rendered by /stats.
+type Stats struct {
+	Entries       int `json:"entries"`
+	CurrentStreak int `json:"current_streak"`
+	LongestStreak int `json:"longest_streak"`
+	// entries per month, keyed like "2013-05"
+	EntriesPerMonth map[string]int `json:"entries_per_month"`
+	WordsPerEntry   []WordBucket   `json:"words_per_entry"`
+	AverageWords    int            `json:"average_words"`
+	// hours from the reminder date to the reply, mail entries only
+	AverageLatencyHours    float64     `json:"average_latency_hours"`
+	Attachments            int         `json:"attachments"`
+	EntriesWithAttachments int         `json:"entries_with_attachments"`
+	CommonWords            []WordCount `json:"common_words"`
+}
+
+// WordBucket counts the entries with at least Min and less than Max words,
+// Max is 0 for the last bucket.
+type WordBucket struct {
+	Min     int `json:"min"`
+	Max     int `json:"max,omitempty"`
+	Entries int `json:"entries"`
+}
+
+type WordCount struct {
+	Word  string `json:"word"`
+	Count int    `json:"count"`
+}
+
+var wordBuckets = []int{0, 50, 100, 200, 500, 1000}
+
+const commonWordsShown = 25
+
+// computeStats goes through all entries once, oldest first so the streaks can
+// be counted on the way. Days are taken in the diary's timezone.
+func computeStats(c appengine.Context, now time.Time, loc *time.Location) (Stats, error) {
+	stats := Stats{
+		EntriesPerMonth: map[string]int{},
+		WordsPerEntry:   []WordBucket{},
+		CommonWords:     []WordCount{},
+	}
+	for i, min := range wordBuckets {
+		b := WordBucket{Min: min}
+		if i+1 < len(wordBuckets) {
+			b.Max = wordBuckets[i+1]
+		}
+		stats.WordsPerEntry = append(stats.WordsPerEntry, b)
+	}
+
+	words := map[string]int{}
+	totalWords := 0
+	latency := time.Duration(0)
+	replies := 0
+	streak := Streak{}
+
+	for t := datastore.NewQuery("DiaryEntry").Order("Date").Run(c); ; {
+		var e DiaryEntry
+		_, err := t.Next(&e)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to iterate over entries: %v", err)
+		}
+
+		date := e.Date.In(loc)
+		stats.Entries++
+		stats.EntriesPerMonth[date.Format("2006-01")]++
+		streak.add(startOfDay(date))
+
+		count := countWords(e.Content, words)
+		totalWords += count
+		for i := len(stats.WordsPerEntry) - 1; i >= 0; i-- {
+			if count >= stats.WordsPerEntry[i].Min {
+				stats.WordsPerEntry[i].Entries++
+				break
+			}
+		}
+
+		sections := entrySections(e)
+		if len(sections) > 0 && sections[0].Source == sourceMail && e.CreationTime.After(e.Date) {
+			latency += e.CreationTime.Sub(e.Date)
+			replies++
+		}
+
+		stats.Attachments += len(e.Attachments)
+		if len(e.Attachments) > 0 {
+			stats.EntriesWithAttachments++
+		}
+	}
+
+	if stats.Entries > 0 {
+		stats.AverageWords = totalWords / stats.Entries
+	}
+	if replies > 0 {
+		stats.AverageLatencyHours = float64(int(10*latency.Hours()/float64(replies))) / 10
+	}
+	stats.CurrentStreak, stats.LongestStreak = streak.At(now.In(loc)), streak.Longest
+
+	for w, n := range words {
+		stats.CommonWords = append(stats.CommonWords, WordCount{Word: w, Count: n})
+	}
+	sort.Sort(wordsByCount(stats.CommonWords))
+	if len(stats.CommonWords) > commonWordsShown {
+		stats.CommonWords = stats.CommonWords[:commonWordsShown]
+	}
+
+	return stats, nil
+}
+
+// countWords returns the number of words in content and adds those worth
+// listing to counts.
+func countWords(content []byte, counts map[string]int) int {
+	words := strings.FieldsFunc(string(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+	for _, w := range words {
+		w = strings.ToLower(strings.Trim(w, "'"))
+		if utf8.RuneCountInString(w) < 3 || stopWords[stem(normalizeWord(w))] {
+			continue
+		}
+		if strings.IndexFunc(w, unicode.IsLetter) < 0 {
+			continue
+		}
+		counts[w]++
+	}
+	return len(words)
+}
+
+type wordsByCount []WordCount
+
+func (w wordsByCount) Len() int      { return len(w) }
+func (w wordsByCount) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+func (w wordsByCount) Less(i, j int) bool {
+	if w[i].Count != w[j].Count {
+		return w[i].Count > w[j].Count
+	}
+	return w[i].Word < w[j].Word
+}
+
+func showStats(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	stats, err := computeStats(c, time.Now(), loc)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderPage(c, w, statsTemplate, "Statistics", newStatsContent(stats))
+}
+
+// statsAPI is the JSON version of the stats page.
+func statsAPI(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	stats, err := computeStats(c, time.Now(), loc)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err = json.NewEncoder(w).Encode(stats); err != nil {
+		c.Errorf("failed to encode stats: %v", err)
+	}
+}
+
+// newStatsContent lays out the entries per month as a year by month grid,
+// each cell with a level from 0 to 4 relative to the busiest month, and the
+// words per entry as bars.
+func newStatsContent(stats Stats) StatsContent {
+	content := StatsContent{
+		Stats:   stats,
+		Heatmap: []HeatmapYearContent{},
+		Words:   []WordBucketContent{},
+	}
+
+	most, first, last := 0, "", ""
+	for month, n := range stats.EntriesPerMonth {
+		if n > most {
+			most = n
+		}
+		if first == "" || month < first {
+			first = month
+		}
+		if month > last {
+			last = month
+		}
+	}
+	if most == 0 {
+		return content
+	}
+
+	start, _ := time.Parse("2006-01", first)
+	end, _ := time.Parse("2006-01", last)
+	for year := start.Year(); year <= end.Year(); year++ {
+		row := HeatmapYearContent{Year: year, Months: []HeatmapMonthContent{}}
+		for month := time.January; month <= time.December; month++ {
+			n := stats.EntriesPerMonth[fmt.Sprintf("%04d-%02d", year, int(month))]
+			// rounded up, so every month with entries shows
+			level := (4*n + most - 1) / most
+			row.Months = append(row.Months, HeatmapMonthContent{
+				Month:   time.Date(year, month, 1, 0, 0, 0, 0, time.UTC),
+				Entries: n,
+				Level:   level,
+			})
+		}
+		content.Heatmap = append(content.Heatmap, row)
+	}
+
+	most = 0
+	for _, b := range stats.WordsPerEntry {
+		if b.Entries > most {
+			most = b.Entries
+		}
+	}
+	for _, b := range stats.WordsPerEntry {
+		label := fmt.Sprintf("%v–%v", b.Min, b.Max-1)
+		if b.Max == 0 {
+			label = fmt.Sprintf("%v+", b.Min)
+		}
+		content.Words = append(content.Words, WordBucketContent{
+			Label:   label,
+			Entries: b.Entries,
+			Percent: 100 * b.Entries / most,
+		})
+	}
+	return content
+}
@@ -0,0 +1,180 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Streak is the number of consecutive days an author wrote an entry, kept up
+// to date as entries are saved so reminders and stats don't have to count.
+type Streak struct {
+	Current int
+	Longest int
+	// the last day of the current streak, in the diary's timezone
+	LastDay    time.Time
+	UpdateTime time.Time
+}
+
+// a late reminder is only worth it for streaks of at least this many days
+const lateReminderStreak = 3
+
+func streakKey(c appengine.Context, author string) *datastore.Key {
+	return datastore.NewKey(c, "Streak", author, 0, nil)
+}
+
+func loadStreak(c appengine.Context, author string) (Streak, error) {
+	var s Streak
+	err := datastore.Get(c, streakKey(c, author), &s)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return s, fmt.Errorf("failed to load streak: %v", err)
+	}
+	return s, nil
+}
+
+// At returns the streak as of today: it's still running if the last entry is
+// from today or yesterday.
+func (s Streak) At(today time.Time) int {
+	today = startOfDay(today)
+	if s.LastDay.Before(today.AddDate(0, 0, -1)) {
+		return 0
+	}
+	return s.Current
+}
+
+// add counts an entry on day, which has to be the start of a day in the
+// diary's timezone, as LastDay is. The day after LastDay extends the streak,
+// a later one starts a new one and days up to LastDay are already counted.
+// Days have to be added in order, see countStreak for the others.
+func (s *Streak) add(day time.Time) {
+	if !s.LastDay.IsZero() && !day.After(s.LastDay) {
+		return
+	}
+	if !s.LastDay.IsZero() && day.Equal(s.LastDay.AddDate(0, 0, 1)) {
+		s.Current++
+	} else {
+		s.Current = 1
+	}
+	s.LastDay = day
+	if s.Current > s.Longest {
+		s.Longest = s.Current
+	}
+}
+
+// updateStreakLater adds a saved entry to the streak of its author. Like
+// syncIdeasLater it is only enqueued if the transaction saving the entry
+// succeeds, so the entry can be read by key. Deleting entries doesn't shorten
+// a streak.
+var updateStreakLater = delay.Func("updateStreak", updateStreak)
+
+func updateStreak(c appengine.Context, entryKey *datastore.Key) error {
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		return fmt.Errorf("failed to load timezone: %v", err)
+	}
+
+	var e DiaryEntry
+	err = datastore.Get(c, entryKey, &e)
+	if err == datastore.ErrNoSuchEntity {
+		// deleted again in the meantime
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to fetch entry: %v", err)
+	}
+	day := startOfDay(e.Date.In(loc))
+
+	recount := false
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		s, err := loadStreak(c, e.Author)
+		if err != nil {
+			return err
+		}
+		s.LastDay = s.LastDay.In(loc)
+		if day.Before(s.LastDay) {
+			// a late reply or a missed day filled in, which may close a gap
+			recount = true
+			return nil
+		}
+		s.add(day)
+		s.UpdateTime = time.Now()
+
+		if _, err = datastore.Put(c, streakKey(c, e.Author), &s); err != nil {
+			return fmt.Errorf("failed to save streak: %v", err)
+		}
+		return nil
+	}, nil)
+	if err != nil || !recount {
+		return err
+	}
+
+	s, err := countStreak(c, loc, day)
+	if err != nil {
+		return err
+	}
+	if _, err = datastore.Put(c, streakKey(c, e.Author), &s); err != nil {
+		return fmt.Errorf("failed to save streak: %v", err)
+	}
+	return nil
+}
+
+// countStreak counts the streak from the dates of all entries. The query may
+// not return an entry saved just before yet, so its day can be given as extra
+// to be counted anyway.
+func countStreak(c appengine.Context, loc *time.Location, extra time.Time) (Streak, error) {
+	s := Streak{}
+	q := datastore.NewQuery("DiaryEntry").Order("Date").Project("Date")
+	for t := q.Run(c); ; {
+		var e DiaryEntry
+		_, err := t.Next(&e)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return s, fmt.Errorf("failed to iterate over entries: %v", err)
+		}
+		day := startOfDay(e.Date.In(loc))
+		if !extra.IsZero() && extra.Before(day) {
+			s.add(extra)
+		}
+		s.add(day)
+	}
+	if !extra.IsZero() {
+		s.add(extra)
+	}
+	s.UpdateTime = time.Now()
+	return s, nil
+}
+
+// recountStreak is a one-off task counting the streak from all entries written
+// before streaks were kept.
+func recountStreak(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	s, err := countStreak(c, loc, time.Time{})
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err = datastore.Put(c, streakKey(c, diaryAuthor), &s); err != nil {
+		c.Errorf("failed to save streak: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Current streak %v days, longest %v days", s.At(time.Now().In(loc)), s.Longest)
+}
@@ -0,0 +1,352 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Extractor finds tags in the lines of an entry. The first group of Pattern
+// is the tag name, which is lower-cased and gets Prefix prepended.
+type Extractor struct {
+	Name    string
+	Pattern string
+	Prefix  string
+	// list items like "- idea: ..." are about the text after the match,
+	// inline tags like #book are about the whole line
+	StripMatch bool
+}
+
+// builtinExtractors always run, the ones added on the tags page run after
+// them. After changing either, /tasks/reindex_entries updates the existing
+// entries.
+var builtinExtractors = []Extractor{
+	{
+		Name:    "hashtags",
+		Pattern: `(?:^|\s)#(\pL[\pL\pN_-]*)`,
+	},
+	{
+		Name:    "mentions",
+		Pattern: `(?:^|\s)@(\pL[\pL\pN_.-]*\pL)`,
+		Prefix:  "@",
+	},
+	{
+		Name:       "list prefixes",
+		Pattern:    `(?i)^\s*[-*]\s*(idea|book|movie|todo|quote):\s*`,
+		StripMatch: true,
+	},
+}
+
+// TagSettings holds the extractors added on the tags page. They are kept in
+// a single entity, loaded once before an entry is saved, see entrySettings.
+type TagSettings struct {
+	Extractors []Extractor
+}
+
+// extractor is an Extractor with its pattern compiled.
+type extractor struct {
+	Extractor
+	pattern *regexp.Regexp
+}
+
+func tagSettingsKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "TagSettings", "default", 0, nil)
+}
+
+func loadTagSettings(c appengine.Context) (TagSettings, error) {
+	var s TagSettings
+	err := datastore.Get(c, tagSettingsKey(c), &s)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return s, fmt.Errorf("failed to load tag settings: %v", err)
+	}
+	return s, nil
+}
+
+// loadExtractors returns the built-in extractors followed by the added ones.
+func loadExtractors(c appengine.Context) ([]extractor, error) {
+	s, err := loadTagSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	all := append([]Extractor{}, builtinExtractors...)
+	return compileExtractors(append(all, s.Extractors...))
+}
+
+func compileExtractors(xs []Extractor) ([]extractor, error) {
+	compiled := []extractor{}
+	for _, x := range xs {
+		pattern, err := regexp.Compile(x.Pattern)
+		if err != nil {
+			// only valid patterns are saved, so this doesn't happen
+			return nil, fmt.Errorf("invalid pattern of extractor '%v': %v", x.Name, err)
+		}
+		compiled = append(compiled, extractor{Extractor: x, pattern: pattern})
+	}
+	return compiled, nil
+}
+
+// TaggedLine is a line of an entry that one of the extractors found a tag in.
+type TaggedLine struct {
+	Tag  string
+	Text string
+}
+
+// extractTags runs the extractors over the lines of content.
+func extractTags(extractors []extractor, content []byte) []TaggedLine {
+	lines := []TaggedLine{}
+	for _, line := range strings.Split(string(content), "\n") {
+		for _, x := range extractors {
+			for _, m := range x.pattern.FindAllStringSubmatchIndex(line, -1) {
+				text := line
+				if x.StripMatch {
+					text = line[m[1]:]
+				}
+				lines = append(lines, TaggedLine{
+					Tag:  x.Prefix + strings.ToLower(line[m[2]:m[3]]),
+					Text: strings.TrimSpace(text),
+				})
+			}
+		}
+	}
+	return lines
+}
+
+// tagNames returns the distinct tags of the lines in the order they appear.
+func tagNames(lines []TaggedLine) []string {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, l := range lines {
+		if !seen[l.Tag] {
+			seen[l.Tag] = true
+			tags = append(tags, l.Tag)
+		}
+	}
+	return tags
+}
+
+func showTags(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	settings, err := loadTagSettings(c)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderTags(c, w, settings, "")
+}
+
+// renderTags shows the tags with their number of entries, followed by the
+// extractors and the error of a rejected one, if any.
+func renderTags(c appengine.Context, w http.ResponseWriter, settings TagSettings, errMsg string) {
+	// a projection on a list property yields one result per value
+	var entries []DiaryEntry
+	_, err := datastore.NewQuery("DiaryEntry").Project("Tags").GetAll(c, &entries)
+	if err != nil {
+		c.Errorf("failed to load tags: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	counts := map[string]int{}
+	for _, e := range entries {
+		for _, tag := range e.Tags {
+			counts[tag]++
+		}
+	}
+
+	content := TagsContent{
+		Tags:       []TagCountContent{},
+		Extractors: []ExtractorContent{},
+		Error:      errMsg,
+	}
+	for tag, count := range counts {
+		content.Tags = append(content.Tags, TagCountContent{Name: tag, Entries: count})
+	}
+	sort.Sort(tagsByCount(content.Tags))
+
+	for _, x := range builtinExtractors {
+		content.Extractors = append(content.Extractors, ExtractorContent{Extractor: x, Builtin: true})
+	}
+	for _, x := range settings.Extractors {
+		content.Extractors = append(content.Extractors, ExtractorContent{Extractor: x})
+	}
+
+	renderPage(c, w, tagsTemplate, "Tags", content)
+}
+
+func addExtractor(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	settings, err := loadTagSettings(c)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	x := Extractor{
+		Name:       strings.TrimSpace(whitespaceRegexp.ReplaceAllString(r.FormValue("name"), " ")),
+		Pattern:    r.FormValue("pattern"),
+		Prefix:     strings.TrimSpace(r.FormValue("prefix")),
+		StripMatch: r.FormValue("strip") != "",
+	}
+
+	errMsg := ""
+	if pattern, err := regexp.Compile(x.Pattern); err != nil {
+		errMsg = fmt.Sprintf("invalid pattern: %v", err)
+	} else if pattern.NumSubexp() == 0 {
+		errMsg = "the pattern needs a group for the tag name"
+	}
+	if strings.ContainsAny(x.Prefix, " \t") {
+		errMsg = "prefixes can't contain spaces"
+	}
+	if x.Name == "" {
+		errMsg = "an extractor needs a name"
+	}
+	for _, existing := range append(append([]Extractor{}, builtinExtractors...), settings.Extractors...) {
+		if strings.EqualFold(existing.Name, x.Name) {
+			errMsg = fmt.Sprintf("there already is an extractor '%v'", existing.Name)
+		}
+	}
+	if errMsg != "" {
+		renderTags(c, w, settings, errMsg)
+		return
+	}
+
+	settings.Extractors = append(settings.Extractors, x)
+	if _, err = datastore.Put(c, tagSettingsKey(c), &settings); err != nil {
+		c.Errorf("failed to save tag settings: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/tags")
+	w.WriteHeader(http.StatusFound)
+}
+
+// deleteExtractor removes an added extractor. Tags already stored on entries
+// stay until they are reindexed.
+func deleteExtractor(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	settings, err := loadTagSettings(c)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	kept := []Extractor{}
+	for _, x := range settings.Extractors {
+		if x.Name != r.FormValue("name") {
+			kept = append(kept, x)
+		}
+	}
+	settings.Extractors = kept
+
+	if _, err = datastore.Put(c, tagSettingsKey(c), &settings); err != nil {
+		c.Errorf("failed to save tag settings: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/tags")
+	w.WriteHeader(http.StatusFound)
+}
+
+type tagsByCount []TagCountContent
+
+func (t tagsByCount) Len() int      { return len(t) }
+func (t tagsByCount) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t tagsByCount) Less(i, j int) bool {
+	if t[i].Entries != t[j].Entries {
+		return t[i].Entries > t[j].Entries
+	}
+	return t[i].Name < t[j].Name
+}
+
+// showTag lists the lines tagged with the name in the path, newest first.
+func showTag(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	name := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/tags/"))
+	if name == "" {
+		showTags(w, r)
+		return
+	}
+
+	lines, err := loadTaggedLines(c, name, loc)
+	if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderPage(c, w, tagTemplate, name, TagContent{Name: name, Lines: lines})
+}
+
+// loadTaggedLines returns the lines tagged with name of all entries.
+func loadTaggedLines(c appengine.Context, name string, loc *time.Location) ([]TaggedLineContent, error) {
+	var entries []DiaryEntry
+	keys, err := datastore.NewQuery("DiaryEntry").Filter("Tags =", name).Order("-Date").GetAll(c, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch entries tagged '%v': %v", name, err)
+	}
+
+	extractors, err := loadExtractors(c)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []TaggedLineContent{}
+	for i, e := range entries {
+		for _, l := range extractTags(extractors, e.Content) {
+			if l.Tag != name {
+				continue
+			}
+			lines = append(lines, TaggedLineContent{
+				Text: l.Text,
+				Date: e.Date.In(loc),
+				Day:  e.Date.In(loc).Format(dateFormat),
+				Key:  keys[i].Encode(),
+			})
+		}
+	}
+	return lines, nil
+}
+
+// showIdeas used to print every list item containing "idea", the idea board
+// covers those now.
+func showIdeas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Location", "/ideas")
+	w.WriteHeader(http.StatusMovedPermanently)
+}
@@ -1,12 +1,16 @@
 package diary
 
 import (
-	"text/template"
+	"appengine"
+	"html/template"
+	"net/http"
 	"time"
 )
 
-const baseTemplateHTML = `
-<!DOCTYPE html>
+// Every page template defines "body", which is rendered into the "base"
+// layout together with the shared partials below. See newPage and renderPage.
+
+const baseTemplateHTML = `{{define "base"}}<!DOCTYPE html>
 <html lang="en">
   <head>
     <meta charset="utf-8">
@@ -24,71 +28,1164 @@ const baseTemplateHTML = `
         <div class="masthead">
         <ul class="nav nav-pills pull-right">
              <li class="active"><a href="/">Diary Entries</a></li>
-             <li><a href="/tasks/reminder">Attachments</a></li>
+             <li><a href="/new">New Entry</a></li>
+             <li><a href="/search">Search</a></li>
+             <li><a href="/calendar">Calendar</a></li>
+             <li><a href="/tags">Tags</a></li>
+             <li><a href="/ideas">Ideas</a></li>
+             <li><a href="/todos">Todos</a></li>
+             <li><a href="/people">People</a></li>
+             <li><a href="/mood">Mood</a></li>
+             <li><a href="/fields">Fields</a></li>
+             <li><a href="/stats">Stats</a></li>
+             <li><a href="/attachments">Attachments</a></li>
              <li><a href="/tasks/reminder">Test Reminder</a></li>
              <li><a href="/add_test_data">Test Data</a></li>
+             <li><a href="/settings/reminder">Reminder</a></li>
+             <li><a href="/prompts">Prompts</a></li>
+             <li><a href="/trash">Trash</a></li>
              <li><a href="/_ah/admin/" target="_blank">Admin</a></li>
         </ul>
         <h3 class="muted">Automatic Diary</h3>
       </div>
       <hr>
-        {{.Body}}
+        {{template "body" .Body}}
     </div>
   </body>
 </html>
-`
+{{end}}`
 
 type BodyContent struct {
-	Body  string
+	Body  interface{}
 	Title string
 }
 
-const entryTemplateHTML = `
+const entryTemplateHTML = `{{define "entry"}}
 <div class="entry row">
-    <h3>{{.Date.Format "Monday, 2. Jan"}}</h3>
-    <p>{{.Content}}</p>
+    <h3><a href="/entry/{{.Day}}">{{.Date.Format "Monday, 2. Jan"}}</a></h3>
+    {{if .Prompt}}<p class="prompt"><a href="/?prompt={{.Prompt}}">{{.Prompt}}</a></p>{{end}}
+    {{template "sections" .Sections}}
+    {{if or .Mood .Energy}}<p class="scores muted">{{if .Mood}}mood {{.Mood}}/10{{end}}{{if and .Mood .Energy}} &middot; {{end}}{{if .Energy}}energy {{.Energy}}/10{{end}}</p>{{end}}
+    {{if .Fields}}<p class="fields muted">{{range $i, $f := .Fields}}{{if $i}} &middot; {{end}}{{.Name}}: {{.Text}}{{end}}</p>{{end}}
+    {{if .Tags}}<p class="tags">{{range .Tags}}<a href="/tags/{{.}}" class="label">{{.}}</a> {{end}}</p>{{end}}
     <span><i>Written on {{.CreationTime.Format "Monday, 2. Jan - 15:04"}}</i></span>
-    <span class="append_link"><a href="/append?key={{.Key | urlquery }}">Append</a></span><br>
-    <div class="attachments">{{.Attachments}}</div>
+    <span class="append_link">
+        <a href="/append?key={{.Key}}">Append</a> &middot;
+        <a href="/edit?key={{.Key}}">Edit</a> &middot;
+        <a href="/history?key={{.Key}}">History</a>
+    </span><br>
+    <div class="attachments">{{range .Attachments}}{{template "attachment" .}}{{end}}</div>
+</div>
+{{end}}`
+
+const richTextTemplateHTML = `{{define "richtext"}}
+{{range .}}{{template "block" .}}{{end}}
+{{end}}
+
+{{define "block"}}
+{{if eq .Kind "heading"}}
+    {{if eq .Level 1}}<h4>{{template "inline" .Inlines}}</h4>
+    {{else if eq .Level 2}}<h5>{{template "inline" .Inlines}}</h5>
+    {{else}}<h6>{{template "inline" .Inlines}}</h6>{{end}}
+{{else if eq .Kind "list"}}
+    {{if .Ordered}}<ol>{{else}}<ul class="{{if (index .Items 0).Checkbox}}unstyled{{end}}">{{end}}
+    {{range .Items}}<li>{{if .Checkbox}}<input type="checkbox" disabled{{if .Checked}} checked{{end}}> {{end}}{{template "inline" .Inlines}}</li>
+    {{end}}
+    {{if .Ordered}}</ol>{{else}}</ul>{{end}}
+{{else if eq .Kind "quote"}}<blockquote><p>{{template "inline" .Inlines}}</p></blockquote>
+{{else if eq .Kind "code"}}<pre>{{.Text}}</pre>
+{{else if eq .Kind "rule"}}<hr>
+{{else}}<p>{{template "inline" .Inlines}}</p>
+{{end}}
+{{end}}
+
+{{define "inline"}}{{range .}}
+{{- if eq .Kind "strong"}}<strong>{{.Text}}</strong>
+{{- else if eq .Kind "emphasis"}}<em>{{.Text}}</em>
+{{- else if eq .Kind "code"}}<code>{{.Text}}</code>
+{{- else if eq .Kind "link"}}<a href="{{.URL}}" rel="nofollow">{{.Text}}</a>
+{{- else if eq .Kind "break"}}<br>
+{{else}}{{.Text}}{{end}}
+{{- end}}{{end}}`
+
+const sectionsTemplateHTML = `{{define "sections"}}
+{{range $i, $section := .}}
+    {{if $i}}<h5 class="muted">Added on {{.CreationTime.Format "Monday, 2. Jan - 15:04"}} via {{.Source}}</h5>{{end}}
+    {{template "richtext" .Content}}
+{{end}}
+{{end}}`
+
+type SectionContent struct {
+	Content      []Block
+	Source       string
+	CreationTime time.Time
+}
+
+const entriesTemplateHTML = `{{define "body"}}
+{{template "navigation" .Navigation}}
+{{if .Prompt}}
+<div class="alert alert-info">
+    Showing entries answering <i>{{.Prompt}}</i> &middot; <a href="/">show all</a>
 </div>
-`
+{{end}}
+{{range .Entries}}{{template "entry" .}}{{end}}
+{{template "pagination" .Navigation}}
+{{end}}`
+
+type EntriesContent struct {
+	Navigation NavigationContent
+	Prompt     string
+	Entries    []EntryContent
+}
 
-const entryAppendTemplateHTML = `
+const entryAppendTemplateHTML = `{{define "body"}}
 <div class="entry">
     <h3>{{.Date.Format "Monday, 2. Jan"}}</h3>
-    <p>{{.Content}}</p>
+    {{template "sections" .Sections}}
     <form action="append_submit" method="post">
-        <input type="hidden" name="key" value="{{.Key | urlquery }}">
+        <input type="hidden" name="key" value="{{.Key}}">
         <textarea rows="5" name="content"></textarea>
         <button type="submit" class="btn btn-primary">Save changes</button>
         <button type="reset" class="btn">Reset</button>
     </form>
 </div>
-`
+{{end}}`
 
 type EntryContent struct {
 	Date         time.Time
+	Day          string // Date formatted for /entry/ links
+	CreationTime time.Time
+	Sections     []SectionContent
+	Key          string
+	Attachments  []AttachmentContent
+	Prompt       string
+	Tags         []string
+	Mood         int
+	Energy       int
+	Fields       []FieldValue
+}
+
+const entryEditTemplateHTML = `{{define "body"}}
+<div class="entry">
+    <h3>{{.Date.Format "Monday, 2. Jan"}}</h3>
+    <form action="/edit_submit" method="post">
+        <input type="hidden" name="key" value="{{.Key}}">
+        {{range .Sections}}
+        <label>Written on {{.CreationTime.Format "Monday, 2. Jan - 15:04"}} via {{.Source}}</label>
+        <textarea rows="10" name="section">{{.Text}}</textarea>
+        {{end}}
+        <p class="muted">Clear a section to remove it.</p>
+        <button type="submit" class="btn btn-primary">Save changes</button>
+        <a href="/entry/{{.Key}}" class="btn">Cancel</a>
+        <span class="pull-right">
+            <a href="/move?key={{.Key}}">Change date</a> &middot;
+            <a href="/history?key={{.Key}}">History</a>
+        </span>
+    </form>
+    {{$entry := .Key}}
+    {{range .Attachments}}
+    <form action="/attachments/delete" method="post" class="span3">
+        <input type="hidden" name="key" value="{{$entry}}">
+        <input type="hidden" name="attachment" value="{{.ID}}">
+        {{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="{{.Name}}" class="img-polaroid">{{else}}{{.Name}}{{end}}
+        <button type="submit" class="btn btn-mini btn-danger">Delete</button>
+    </form>
+    {{end}}
+    <form action="/delete" method="post" class="clearfix" onsubmit="return confirm('Move this entry to the trash?');">
+        <input type="hidden" name="key" value="{{.Key}}">
+        <button type="submit" class="btn btn-danger">Delete entry</button>
+    </form>
+</div>
+{{end}}`
+
+type EntryEditContent struct {
+	Date        time.Time
+	Key         string
+	Sections    []SectionEditContent
+	Attachments []AttachmentContent
+}
+
+type SectionEditContent struct {
+	Text         string
+	Source       string
 	CreationTime time.Time
-	Content      string
+}
+
+const historyTemplateHTML = `{{define "body"}}
+<h3>History of <a href="/entry/{{.Key}}">{{.Date.Format "Monday, 2. Jan"}}</a></h3>
+{{$entry := .Key}}
+{{range .Revisions}}
+<div class="revision">
+    <h5>
+        {{.CreationTime.Format "Monday, 2. Jan 2006 - 15:04"}} via {{.Source}}
+        {{if .Current}}<span class="label label-info">current</span>{{else}}
+        <form action="/restore" method="post" class="pull-right">
+            <input type="hidden" name="key" value="{{$entry}}">
+            <input type="hidden" name="revision" value="{{.Key}}">
+            <button type="submit" class="btn btn-mini">Restore</button>
+        </form>
+        {{end}}
+    </h5>
+    <pre class="diff">{{range .Diff}}<span class="diff-{{.Kind}}">{{if eq .Kind "added"}}+{{else if eq .Kind "removed"}}-{{else}} {{end}} {{.Text}}</span>
+{{end}}</pre>
+</div>
+{{end}}
+{{end}}`
+
+type RevisionContent struct {
 	Key          string
-	Attachments  string
+	Source       string
+	CreationTime time.Time
+	Diff         []DiffLine
+	Current      bool
+}
+
+type HistoryContent struct {
+	Date      time.Time
+	Key       string
+	Revisions []RevisionContent
+}
+
+const newEntryTemplateHTML = `{{define "body"}}
+<div class="entry">
+    <h3>New entry</h3>
+    <form id="new-entry" action="{{.UploadURL}}" method="post" enctype="multipart/form-data">
+        <label>Date</label>
+        <input type="date" name="date" value="{{.Date}}">
+        <textarea rows="15" name="content" placeholder="Markdown is supported">{{.Content}}</textarea>
+        <div class="dropzone">
+            Drop photos here or <input type="file" name="attachments" multiple>
+            <ul class="dropped-files unstyled"></ul>
+        </div>
+        <button type="submit" class="btn btn-primary">Save entry</button>
+        <span class="draft-status muted">{{if not .DraftTime.IsZero}}Draft from {{.DraftTime.Format "Monday, 2. Jan - 15:04"}}{{end}}</span>
+    </form>
+</div>
+<script src="/assets/javascripts/new_entry.js"></script>
+{{end}}`
+
+type NewEntryContent struct {
+	UploadURL string
+	Date      string
+	Content   string
+	DraftTime time.Time
+}
+
+const moveTemplateHTML = `{{define "body"}}
+<div class="entry">
+    <h3>Move {{.Date.Format "Monday, 2. Jan 2006"}}</h3>
+    {{template "sections" .Sections}}
+    <form action="/move_submit" method="post" class="form-inline">
+        <input type="hidden" name="key" value="{{.Key}}">
+        <label>File under</label>
+        <input type="date" name="date" value="{{.Target}}">
+        <button type="submit" class="btn btn-primary">Change date</button>
+        <a href="/entry/{{.Key}}" class="btn">Cancel</a>
+    </form>
+</div>
+{{if .Conflicts}}
+<div class="alert">
+    There already is an entry on {{.Target}}. Merge into it, or pick another day.
+</div>
+{{$key := .Key}}{{$target := .Target}}
+{{range .Conflicts}}
+{{template "entry" .}}
+<form action="/move_submit" method="post">
+    <input type="hidden" name="key" value="{{$key}}">
+    <input type="hidden" name="date" value="{{$target}}">
+    <input type="hidden" name="merge" value="{{.Key}}">
+    <button type="submit" class="btn btn-warning">Merge into this entry</button>
+</form>
+{{end}}
+{{end}}
+{{end}}`
+
+type MoveContent struct {
+	Date      time.Time
+	Key       string
+	Target    string // date formatted like dateFormat
+	Sections  []SectionContent
+	Conflicts []EntryContent
+}
+
+const searchTemplateHTML = `{{define "body"}}
+<form action="/search" method="get" class="form-inline">
+    <input type="text" name="q" value="{{.Query}}" placeholder="Words or &quot;a phrase&quot;" class="input-xlarge">
+    <input type="date" name="from" value="{{.From}}" class="input-medium">
+    <input type="date" name="to" value="{{.To}}" class="input-medium">
+    <button type="submit" class="btn btn-primary">Search</button>
+</form>
+{{if .Error}}<div class="alert alert-error">{{.Error}}</div>{{end}}
+{{if .Searched}}
+<p class="muted">{{len .Results}} entries found</p>
+{{range .Results}}
+<div class="search-result">
+    <h4><a href="/entry/{{.Day}}">{{.Date.Format "Monday, 2. Jan 2006"}}</a></h4>
+    <p>{{range .Snippet}}{{if .Match}}<mark>{{.Text}}</mark>{{else}}{{.Text}}{{end}}{{end}}</p>
+</div>
+{{end}}
+{{end}}
+{{end}}`
+
+type SearchContent struct {
+	Query    string
+	From     string
+	To       string
+	Error    string
+	Searched bool
+	Results  []SearchResult
+}
+
+const tagsTemplateHTML = `{{define "body"}}
+<h3>Tags</h3>
+{{if .Tags}}
+<ul class="unstyled">
+{{range .Tags}}
+    <li><a href="/tags/{{.Name}}">{{.Name}}</a> <span class="muted">{{.Entries}}</span></li>
+{{end}}
+</ul>
+{{else}}
+<p class="muted">No tags yet. Write <code>#tag</code>, <code>@name</code> or <code>- idea: ...</code> in an entry.</p>
+{{end}}
+<h4>Extractors</h4>
+{{if .Error}}<div class="alert alert-error">{{.Error}}</div>{{end}}
+<p>The first group of a pattern is the tag. Changes apply to new entries,
+<a href="/tasks/reindex_entries">reindex</a> to update the others.</p>
+<table class="table">
+    {{range .Extractors}}
+    <tr>
+        <td>{{.Name}}</td>
+        <td><code>{{.Pattern}}</code></td>
+        <td>{{.Prefix}}</td>
+        <td>{{if .StripMatch}}text after the match{{else}}whole line{{end}}</td>
+        <td>
+            {{if .Builtin}}<span class="muted">built-in</span>{{else}}
+            <form action="/tags/extractors/delete" method="post">
+                <input type="hidden" name="name" value="{{.Name}}">
+                <button type="submit" class="btn btn-mini">Delete</button>
+            </form>
+            {{end}}
+        </td>
+    </tr>
+    {{end}}
+</table>
+<form action="/tags/extractors/add" method="post" class="form-inline">
+    <input type="text" name="name" placeholder="Name, like places" class="input-small">
+    <input type="text" name="pattern" placeholder="Pattern, like (?:^|\s)\+(\pL+)">
+    <input type="text" name="prefix" placeholder="Prefix, like +" class="input-small">
+    <label class="checkbox"><input type="checkbox" name="strip"> only the text after the match</label>
+    <button type="submit" class="btn btn-primary">Add</button>
+</form>
+{{end}}`
+
+type TagCountContent struct {
+	Name    string
+	Entries int
+}
+
+type TagsContent struct {
+	Tags       []TagCountContent
+	Extractors []ExtractorContent
+	Error      string
+}
+
+type ExtractorContent struct {
+	Extractor
+	Builtin bool
+}
+
+const tagTemplateHTML = `{{define "body"}}
+<h3><a href="/tags">Tags</a> / {{.Name}}</h3>
+{{range .Lines}}
+<div class="tagged-line">
+    <a href="/entry/{{.Day}}" class="muted">{{.Date.Format "2. Jan 2006"}}</a> {{.Text}}
+</div>
+{{else}}
+<p class="muted">Nothing tagged {{.Name}}.</p>
+{{end}}
+{{end}}`
+
+type TaggedLineContent struct {
+	Text string
+	Date time.Time
+	Day  string // Date formatted for /entry/ links
+	Key  string
+}
+
+type TagContent struct {
+	Name  string
+	Lines []TaggedLineContent
+}
+
+const ideaBoardTemplateHTML = `{{define "body"}}
+<h3>Ideas</h3>
+<div class="row idea-board">
+{{range .Columns}}
+    <div class="span2">
+        <h5>{{.Status}} <span class="muted">{{len .Ideas}}</span></h5>
+        {{range .Ideas}}
+        <div class="well well-small idea">
+            <a href="/ideas/{{.ID}}">{{.Text}}</a>
+            <p class="muted"><a href="/entry/{{.Entry}}">{{.Date.Format "2. Jan 2006"}}</a>{{if .Mentions}} &middot; {{len .Mentions}} mentions{{end}}</p>
+            <form action="/ideas/update" method="post">
+                <input type="hidden" name="id" value="{{.ID}}">
+                {{$current := .Status}}
+                {{range .Statuses}}{{if ne . $current}}<button type="submit" name="status" value="{{.}}" class="btn btn-mini">{{.}}</button> {{end}}{{end}}
+            </form>
+        </div>
+        {{end}}
+    </div>
+{{end}}
+</div>
+{{end}}`
+
+type IdeaBoardContent struct {
+	Columns []IdeaColumnContent
+}
+
+type IdeaColumnContent struct {
+	Status string
+	Ideas  []IdeaContent
+}
+
+const ideaTemplateHTML = `{{define "body"}}
+<div class="entry">
+    <h3><a href="/ideas">Ideas</a> / idea #{{.ID}}</h3>
+    <p class="lead">{{.Text}}</p>
+    <p>Written down on <a href="/entry/{{.Entry}}">{{.Date.Format "Monday, 2. Jan 2006"}}</a></p>
+    {{if .Mentions}}
+    <p>Mentioned again in
+    {{range $i, $m := .Mentions}}{{if $i}}, {{end}}<a href="/entry/{{.Key}}">{{if .Date.IsZero}}a deleted entry{{else}}{{.Date.Format "2. Jan 2006"}}{{end}}</a>{{end}}
+    </p>
+    {{end}}
+    <form action="/ideas/update" method="post">
+        <input type="hidden" name="id" value="{{.ID}}">
+        <input type="hidden" name="return" value="idea">
+        <label>Status</label>
+        <select name="status">
+        {{$current := .Status}}
+        {{range .Statuses}}<option{{if eq . $current}} selected{{end}}>{{.}}</option>{{end}}
+        </select>
+        <label>Notes</label>
+        <textarea rows="8" name="notes">{{.Notes}}</textarea>
+        <button type="submit" class="btn btn-primary">Save changes</button>
+    </form>
+    <p class="muted">Write <code>idea #{{.ID}}</code> in an entry to link it here.</p>
+</div>
+{{end}}`
+
+type IdeaContent struct {
+	ID       int64
+	Text     string
+	Status   string
+	Notes    string
+	Date     time.Time
+	Entry    string
+	Mentions []IdeaMentionContent
+	Statuses []string
+}
+
+type IdeaMentionContent struct {
+	Key  string
+	Date time.Time
+}
+
+const todosTemplateHTML = `{{define "body"}}
+<h3>Todos</h3>
+{{if .Open}}
+<ul class="unstyled todos">
+{{range .Open}}{{template "todo" .}}{{end}}
+</ul>
+{{else}}
+<p class="muted">Nothing to do. Write <code>- [ ] something</code> in an entry to add a todo.</p>
+{{end}}
+{{if .Done}}
+<h5 class="muted">Recently done</h5>
+<ul class="unstyled todos">
+{{range .Done}}{{template "todo" .}}{{end}}
+</ul>
+{{end}}
+{{end}}
+
+{{define "todo"}}
+<li>
+    <form action="/todos/toggle" method="post" class="form-inline">
+        <input type="hidden" name="key" value="{{.Key}}">
+        <input type="hidden" name="text" value="{{.Text}}">
+        {{if .Done}}
+        <button type="submit" class="btn btn-mini" title="Open again">&#10003;</button> <del>{{.Text}}</del>
+        {{else}}
+        <button type="submit" name="done" value="1" class="btn btn-mini" title="Done">&nbsp;&nbsp;</button> {{.Text}}
+        {{end}}
+        <a href="/entry/{{.Day}}" class="muted">{{.Date.Format "2. Jan"}}</a>
+    </form>
+</li>
+{{end}}`
+
+type TodoContent struct {
+	Key  string
+	Text string
+	Done bool
+	Date time.Time
+	Day  string // Date formatted for /entry/ links
+}
+
+type TodosContent struct {
+	Open []TodoContent
+	Done []TodoContent
+}
+
+const peopleTemplateHTML = `{{define "body"}}
+<h3>People</h3>
+{{if .People}}
+<table class="table">
+    <tr><th>Name</th><th>Entries</th><th>First</th><th>Last</th></tr>
+    {{range .People}}
+    <tr>
+        <td><a href="/people/{{.Name}}">{{.Name}}</a></td>
+        <td>{{.Entries}}</td>
+        <td>{{.First.Format "2. Jan 2006"}}</td>
+        <td>{{.Last.Format "2. Jan 2006"}}</td>
+    </tr>
+    {{end}}
+</table>
+{{else}}
+<p class="muted">Nobody yet. Mention people as <code>@name</code> in an entry.</p>
+{{end}}
+<h4>Aliases</h4>
+{{if .Error}}<div class="alert alert-error">{{.Error}}</div>{{end}}
+<p>One person per line, followed by the names they go by, like <code>Mum: Mama, Mutti, @mama</code>.
+Names starting with @ only match mentions. Changes apply to new entries,
+<a href="/tasks/reindex_entries">reindex</a> to update the others.</p>
+<form action="/people/aliases" method="post">
+    <textarea rows="8" name="aliases">{{.Aliases}}</textarea>
+    <button type="submit" class="btn btn-primary">Save aliases</button>
+</form>
+{{end}}`
+
+type PeopleContent struct {
+	People  []PersonContent
+	Aliases string
+	Error   string
+}
+
+const personTemplateHTML = `{{define "body"}}
+<h3><a href="/people">People</a> / {{.Name}}</h3>
+<p>In {{.Entries}} entries, first on <a href="/entry/{{.First.Format "2006-01-02"}}">{{.First.Format "2. Jan 2006"}}</a>,
+last on <a href="/entry/{{.Last.Format "2006-01-02"}}">{{.Last.Format "2. Jan 2006"}}</a>.</p>
+<table class="table table-condensed frequency">
+    {{range .Months}}
+    <tr>
+        <td class="span2">{{.Month.Format "Jan 2006"}}</td>
+        <td><div class="bar" style="width: {{.Percent}}%">{{if .Entries}}{{.Entries}}{{end}}</div></td>
+    </tr>
+    {{end}}
+</table>
+{{range .List}}{{template "entry" .}}{{end}}
+{{end}}`
+
+// PersonContent is a row of the people page, or with Months and List filled
+// in, the page of one person.
+type PersonContent struct {
+	Name    string
+	Entries int
+	First   time.Time
+	Last    time.Time
+	Months  []MonthCountContent
+	List    []EntryContent
 }
 
-const attachmentTemplateHTML = `
+// MonthCountContent is one bar of a frequency chart. Percent is relative to
+// the busiest month.
+type MonthCountContent struct {
+	Month   time.Time
+	Entries int
+	Percent int
+}
+
+const moodTemplateHTML = `{{define "body"}}
+<h3>Mood and energy</h3>
+<p>
+    {{.Start.Format "2. Jan 2006"}} to {{.End.Format "2. Jan 2006"}} &middot;
+    <a href="/mood?days=30">30 days</a> &middot;
+    <a href="/mood?days=90">90 days</a> &middot;
+    <a href="/mood?days=365">a year</a>
+</p>
+{{if or .Mood.Points .Energy.Points}}
+<svg class="chart" width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+    <line x1="0" y1="{{.Height}}" x2="{{.Width}}" y2="{{.Height}}" class="axis"></line>
+    {{range .Series}}
+    <g class="series-{{.Name}}">
+        <polyline points="{{.Line}}"></polyline>
+        {{range .Points}}<circle cx="{{.X}}" cy="{{.Y}}" r="3"><title>{{.Date.Format "2. Jan"}}: {{.Score}}</title></circle>{{end}}
+    </g>
+    {{end}}
+</svg>
+<p>
+    {{range .Series}}<span class="legend-{{.Name}}">&#9632;</span> {{.Name}}{{if .Average}}, {{.Average}} on average{{end}} &nbsp;{{end}}
+</p>
+{{else}}
+<p class="muted">No scores yet. Start a reply with <code>mood: 7, energy: 5</code> or an emoji like &#128578;.</p>
+{{end}}
+{{end}}`
+
+type MoodContent struct {
+	Days   int
+	Start  time.Time
+	End    time.Time
+	Width  int
+	Height int
+	Mood   ScoreSeriesContent
+	Energy ScoreSeriesContent
+}
+
+func (m MoodContent) Series() []ScoreSeriesContent {
+	return []ScoreSeriesContent{m.Mood, m.Energy}
+}
+
+// ScoreSeriesContent is one line of the chart. Line holds the coordinates of
+// the points for a polyline.
+type ScoreSeriesContent struct {
+	Name    string
+	Points  []ChartPointContent
+	Line    string
+	Average string
+}
+
+type ChartPointContent struct {
+	X, Y  int
+	Date  time.Time
+	Score int
+}
+
+const fieldsTemplateHTML = `{{define "body"}}
+<h3>Fields</h3>
+{{if .Fields}}
+<p>
+    {{if .Monthly}}<a href="/fields">By week</a> &middot; by month{{else}}By week &middot; <a href="/fields?by=month">by month</a>{{end}}
+</p>
+<table class="table table-condensed">
+    <tr>
+        <th></th>
+        {{range .Fields}}<th>{{.Name}}{{if .Unit}} <span class="muted">({{.Unit}})</span>{{end}}</th>{{end}}
+    </tr>
+    {{range .Periods}}
+    <tr>
+        <td>{{.Start.Format "2. Jan"}} – {{.End.Format "2. Jan 2006"}}</td>
+        {{range .Stats}}
+        <td>{{if .Days}}{{.Summary}}{{if .Range}}<br><span class="muted">{{.Range}}</span>{{end}}{{else}}<span class="muted">–</span>{{end}}</td>
+        {{end}}
+    </tr>
+    {{end}}
+</table>
+{{end}}
+<h4>Defined fields</h4>
+{{if .Error}}<div class="alert alert-error">{{.Error}}</div>{{end}}
+<p>Write a line like <code>sleep: 7.5h</code> in an entry to record a value. Changes apply to new entries,
+<a href="/tasks/reindex_entries">reindex</a> to update the others.</p>
+<table class="table">
+    {{range .Fields}}
+    <tr>
+        <td>{{.Name}}</td>
+        <td>{{.Type}}</td>
+        <td>{{.Unit}}</td>
+        <td>
+            <form action="/fields/delete" method="post">
+                <input type="hidden" name="name" value="{{.Name}}">
+                <button type="submit" class="btn btn-mini">Delete</button>
+            </form>
+        </td>
+    </tr>
+    {{end}}
+</table>
+<form action="/fields/add" method="post" class="form-inline">
+    <input type="text" name="name" placeholder="Name, like sleep">
+    <select name="type" class="input-small">{{range .Types}}<option>{{.}}</option>{{end}}</select>
+    <input type="text" name="unit" placeholder="Unit, like h" class="input-small">
+    <button type="submit" class="btn btn-primary">Add</button>
+</form>
+{{end}}`
+
+type FieldsContent struct {
+	Monthly bool
+	Fields  []FieldSchemaContent
+	Periods []FieldPeriodContent
+	Types   []string
+	Error   string
+}
+
+type FieldSchemaContent struct {
+	Name string
+	Type string
+	Unit string
+}
+
+// FieldPeriodContent is a row of the stats table, with the stats of each
+// field in the order of FieldsContent.Fields.
+type FieldPeriodContent struct {
+	Start time.Time
+	End   time.Time
+	Stats []FieldStatsContent
+}
+
+type FieldStatsContent struct {
+	Days    int
+	Summary string
+	Range   string
+}
+
+const statsTemplateHTML = `{{define "body"}}
+<h3>Statistics</h3>
+<p><a href="/api/stats">As JSON</a></p>
+<table class="table table-condensed">
+    <tr><td class="span3">Entries</td><td>{{.Entries}}</td></tr>
+    <tr><td>Current streak</td><td>{{.CurrentStreak}} days</td></tr>
+    <tr><td>Longest streak</td><td>{{.LongestStreak}} days</td></tr>
+    <tr><td>Words per entry</td><td>{{.AverageWords}} on average</td></tr>
+    <tr><td>Reply latency</td><td>{{if .AverageLatencyHours}}{{.AverageLatencyHours}} hours on average after the reminder{{else}}<span class="muted">no replies yet</span>{{end}}</td></tr>
+    <tr><td>Attachments</td><td>{{.Attachments}} in {{.EntriesWithAttachments}} entries</td></tr>
+</table>
+{{if .Heatmap}}
+<h4>Entries per month</h4>
+<table class="table table-condensed heatmap">
+    <tr>
+        <th></th>
+        {{range (index .Heatmap 0).Months}}<th>{{.Month.Format "Jan"}}</th>{{end}}
+    </tr>
+    {{range .Heatmap}}
+    <tr>
+        <td>{{.Year}}</td>
+        {{range .Months}}<td class="level-{{.Level}}" title="{{.Month.Format "Jan 2006"}}: {{.Entries}}">{{if .Entries}}{{.Entries}}{{end}}</td>{{end}}
+    </tr>
+    {{end}}
+</table>
+<h4>Words per entry</h4>
+<table class="table table-condensed frequency">
+    {{range .Words}}
+    <tr>
+        <td class="span2">{{.Label}}</td>
+        <td><div class="bar" style="width: {{.Percent}}%">{{if .Entries}}{{.Entries}}{{end}}</div></td>
+    </tr>
+    {{end}}
+</table>
+{{end}}
+{{if .CommonWords}}
+<h4>Most common words</h4>
+<p>{{range .CommonWords}}<span class="label">{{.Word}} {{.Count}}</span> {{end}}</p>
+{{end}}
+{{end}}`
+
+// StatsContent adds the layout of the charts to the stats.
+type StatsContent struct {
+	Stats
+	Heatmap []HeatmapYearContent
+	Words   []WordBucketContent
+}
+
+// HeatmapYearContent is a row of the entries per month heatmap.
+type HeatmapYearContent struct {
+	Year   int
+	Months []HeatmapMonthContent
+}
+
+type HeatmapMonthContent struct {
+	Month   time.Time
+	Entries int
+	Level   int
+}
+
+type WordBucketContent struct {
+	Label   string
+	Entries int
+	Percent int
+}
+
+const calendarTemplateHTML = `{{define "body"}}
+<h3>
+    <a href="/calendar?month={{.Previous}}">&larr;</a>
+    {{.Month.Format "January 2006"}}
+    {{if .Next}}<a href="/calendar?month={{.Next}}">&rarr;</a>{{end}}
+</h3>
+<table class="table table-bordered calendar">
+    <tr><th>Mon</th><th>Tue</th><th>Wed</th><th>Thu</th><th>Fri</th><th>Sat</th><th>Sun</th></tr>
+    {{range .Weeks}}
+    <tr>
+        {{range .}}
+        {{if not .InMonth}}
+        <td class="outside">{{.Date.Day}}</td>
+        {{else if .Entries}}
+        <td class="written{{if .Today}} today{{end}}">
+            <a href="/entry/{{.Day}}">{{.Date.Day}}</a>
+            <div class="indicators">
+                {{if gt .Entries 1}}<span title="{{.Entries}} entries">{{.Entries}}&times;</span>{{end}}
+                {{if .Attachments}}<span title="{{.Attachments}} attachments">&#128247;</span>{{end}}
+                {{if .Mood}}<span class="mood" title="mood">{{.Mood}}</span>{{end}}
+            </div>
+        </td>
+        {{else if .Missing}}
+        <td class="missing{{if .Today}} today{{end}}"><a href="/new?date={{.Day}}" title="no entry, write one">{{.Date.Day}}</a></td>
+        {{else}}
+        <td>{{.Date.Day}}</td>
+        {{end}}
+        {{end}}
+    </tr>
+    {{end}}
+</table>
+<p class="muted">{{if .Missing}}{{.Missing}} days without an entry this month.{{else}}No missing days this month.{{end}}</p>
+{{end}}`
+
+type CalendarContent struct {
+	Month time.Time
+	// months as YYYY-MM, Next is empty for the current month
+	Previous string
+	Next     string
+	Weeks    [][]CalendarDayContent
+	Missing  int
+}
+
+// CalendarDayContent is a cell of the calendar. Days of the previous and next
+// month fill up the first and last week.
+type CalendarDayContent struct {
+	Date        time.Time
+	Day         string
+	InMonth     bool
+	Today       bool
+	Entries     int
+	Attachments int
+	Mood        int
+	// past days of the month without an entry
+	Missing bool
+}
+
+const galleryTemplateHTML = `{{define "body"}}
+<h3>Attachments</h3>
+{{range .Days}}
+<div class="gallery-day">
+    <h4><a href="/entry/{{.Day}}">{{.Date.Format "Monday, 2. Jan 2006"}}</a></h4>
+    {{range .Photos}}
+    {{if .BigImage}}
+    <a href="{{.BigImage}}" class="gallery-photo" data-entry="/entry/{{.Entry}}" title="{{.Name}}">
+        <img src="{{.Thumbnail}}" alt="{{.Name}}" class="img-polaroid">
+    </a>
+    {{else}}
+    <a href="/attachment?key={{.Key}}" class="gallery-file" title="{{.Name}}">{{.Name}}</a>
+    {{end}}
+    {{end}}
+</div>
+{{else}}
+<p class="muted">No attachments yet.</p>
+{{end}}
+<ul class="pager">
+    {{if .Newest}}<li class="previous"><a href="{{.Newest}}">&larr; Newest</a></li>{{end}}
+    {{if .Older}}<li class="next"><a href="{{.Older}}">Older &rarr;</a></li>{{end}}
+</ul>
+<div class="lightbox" style="display: none">
+    <img src="" alt="">
+    <p><span class="lightbox-name"></span> &middot; <a href="" class="lightbox-entry">Go to entry</a></p>
+</div>
+<script src="/assets/javascripts/gallery.js"></script>
+{{end}}`
+
+// GalleryContent is one page of attachments, Older and Newest link to the
+// neighbouring pages.
+type GalleryContent struct {
+	Days   []GalleryDayContent
+	Older  string
+	Newest string
+}
+
+type GalleryDayContent struct {
+	Date   time.Time
+	Day    string
+	Photos []GalleryPhotoContent
+}
+
+// GalleryPhotoContent is an attachment together with the key of its entry.
+type GalleryPhotoContent struct {
+	AttachmentContent
+	Entry string
+}
+
+const trashTemplateHTML = `{{define "body"}}
+<h3>Trash</h3>
+{{if or .Entries .Attachments}}
+<form action="/trash/empty" method="post" onsubmit="return confirm('Delete everything in the trash for good?');">
+    <button type="submit" class="btn btn-danger">Empty trash</button>
+</form>
+{{else}}
+<p class="muted">The trash is empty.</p>
+{{end}}
+{{range .Entries}}
+<div class="entry">
+    <h4>{{.Date.Format "Monday, 2. Jan 2006"}}</h4>
+    {{template "sections" .Sections}}
+    <span><i>Deleted on {{.DeletionTime.Format "Monday, 2. Jan - 15:04"}}{{if .Attachments}}, with {{.Attachments}} attachments{{end}}</i></span>
+    {{template "trashActions" .Key}}
+</div>
+{{end}}
+{{range .Attachments}}
+<div class="entry">
+    {{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="{{.Name}}" class="img-polaroid">{{else}}<h4>{{.Name}}</h4>{{end}}
+    <span><i>Deleted on {{.DeletionTime.Format "Monday, 2. Jan - 15:04"}}</i></span>
+    {{template "trashActions" .Key}}
+</div>
+{{end}}
+{{end}}
+
+{{define "trashActions"}}
+<form action="/trash/restore" method="post" class="form-inline">
+    <input type="hidden" name="key" value="{{.}}">
+    <button type="submit" class="btn btn-mini">Restore</button>
+    <button type="submit" formaction="/trash/purge" class="btn btn-mini btn-danger">Delete for good</button>
+</form>
+{{end}}`
+
+type TrashedEntryContent struct {
+	Key          string
+	Date         time.Time
+	DeletionTime time.Time
+	Sections     []SectionContent
+	Attachments  int
+}
+
+type TrashedAttachmentContent struct {
+	Key          string
+	Name         string
+	Thumbnail    string
+	DeletionTime time.Time
+}
+
+type TrashContent struct {
+	Entries     []TrashedEntryContent
+	Attachments []TrashedAttachmentContent
+}
+
+const attachmentTemplateHTML = `{{define "attachment"}}
 <span class="span4">
-  <a href="/attachment?key={{.Key | urlquery }}">
-    <img src="{{.Thumbnail}}" alt="{{.Name}}" class="img-polaroid">
+  <a href="/attachment?key={{.Key}}">
+    {{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="{{.Name}}" class="img-polaroid">{{else}}{{.Name}}{{end}}
   </a>
 </span>
-`
+{{end}}`
 
 type AttachmentContent struct {
+	ID        string // datastore key of the Attachment
 	Name      string
-	Key       string
+	Key       string // blob key
 	Thumbnail string
+	BigImage  string
+}
+
+const entryPageTemplateHTML = `{{define "body"}}
+<ul class="pager">
+    {{if .Previous}}<li class="previous"><a href="/entry/{{.Previous}}">&larr; {{.Previous}}</a></li>{{end}}
+    {{if .Next}}<li class="next"><a href="/entry/{{.Next}}">{{.Next}} &rarr;</a></li>{{end}}
+</ul>
+<h2>{{.Date.Format "Monday, 2. Jan 2006"}}</h2>
+{{range .Entries}}
+<div class="entry">
+    {{if .Prompt}}<p class="prompt"><a href="/?prompt={{.Prompt}}">{{.Prompt}}</a></p>{{end}}
+    {{template "sections" .Sections}}
+    {{if or .Mood .Energy}}<p class="scores muted">{{if .Mood}}mood {{.Mood}}/10{{end}}{{if and .Mood .Energy}} &middot; {{end}}{{if .Energy}}energy {{.Energy}}/10{{end}}</p>{{end}}
+    {{if .Fields}}<p class="fields muted">{{range $i, $f := .Fields}}{{if $i}} &middot; {{end}}{{.Name}}: {{.Text}}{{end}}</p>{{end}}
+    {{if .Tags}}<p class="tags">{{range .Tags}}<a href="/tags/{{.}}" class="label">{{.}}</a> {{end}}</p>{{end}}
+    <span><i>Written on {{.CreationTime.Format "Monday, 2. Jan - 15:04"}}</i></span>
+    <span class="append_link">
+        <a href="/append?key={{.Key}}">Append</a> &middot;
+        <a href="/edit?key={{.Key}}">Edit</a> &middot;
+        <a href="/history?key={{.Key}}">History</a>
+    </span><br>
+    <div class="attachments">
+    {{range .Attachments}}
+        <a href="/attachment?key={{.Key}}">
+            <img src="{{if .BigImage}}{{.BigImage}}{{else}}{{.Thumbnail}}{{end}}" alt="{{.Name}}" class="img-polaroid">
+        </a>
+    {{end}}
+    </div>
+</div>
+{{end}}
+{{end}}`
+
+// EntryPageContent is the permalink page of one day. Previous and Next are
+// the closest days with entries, empty if there are none.
+type EntryPageContent struct {
+	Date     time.Time
+	Entries  []EntryContent
+	Previous string
+	Next     string
+}
+
+const reminderSettingsTemplateHTML = `{{define "body"}}
+<div class="entry">
+    <h3>Reminder mail</h3>
+    {{if .Error}}<div class="alert alert-error">{{.Error}}</div>{{end}}
+    <p>Available fields: <code>{{"{{.Date}}"}}</code>, <code>{{"{{.Prompt}}"}}</code>,
+    <code>{{"{{.Todos}}"}}</code>, <code>{{"{{.Streak}}"}}</code>, <code>{{"{{.Late}}"}}</code> and <code>{{"{{.Tag}}"}}</code>.
+    The tag is added automatically if a template leaves it out. <code>{{"{{.Late}}"}}</code> is set for the second reminder,
+    sent late in the evening when a streak of {{.LateStreak}} or more days is about to break.</p>
+    <form action="/settings/reminder_submit" method="post">
+        <label>Subject</label>
+        <input type="text" name="subject" value="{{.Subject}}">
+        <label>Plain text</label>
+        <textarea rows="10" name="text">{{.Text}}</textarea>
+        <label>HTML</label>
+        <textarea rows="10" name="html">{{.HTML}}</textarea>
+        <button type="submit" class="btn btn-primary">Save changes</button>
+        <button type="submit" name="reset" value="1" class="btn">Restore defaults</button>
+    </form>
+    {{if .Preview}}
+    <h4>Preview</h4>
+    <pre>{{.Preview}}</pre>
+    {{end}}
+</div>
+{{end}}`
+
+type ReminderSettingsContent struct {
+	Subject    string
+	Text       string
+	HTML       string
+	Preview    string
+	Error      string
+	LateStreak int
+}
+
+const promptsTemplateHTML = `{{define "body"}}
+<div class="entry">
+    <h3>Writing prompts</h3>
+    <form action="/prompts/settings" method="post" class="form-inline">
+        Don't repeat a prompt within
+        <input type="text" name="window" value="{{.Window}}" class="input-mini"> days,
+        only use themes
+        <input type="text" name="themes" value="{{.Themes}}" placeholder="all themes">
+        <button type="submit" class="btn">Save</button>
+    </form>
+    <table class="table">
+        <tr><th>Prompt</th><th>Themes</th><th></th></tr>
+        {{range .Prompts}}
+        <tr>
+            <td><a href="/?prompt={{.Text}}">{{.Text}}</a></td>
+            <td>{{.Themes}}</td>
+            <td>{{if .Key}}
+                <form action="/prompts/delete" method="post">
+                    <input type="hidden" name="key" value="{{.Key}}">
+                    <button type="submit" class="btn btn-mini">Delete</button>
+                </form>
+            {{else}}<span class="muted">built-in</span>{{end}}</td>
+        </tr>
+        {{end}}
+    </table>
+    <form action="/prompts/add" method="post">
+        <input type="text" name="text" placeholder="New prompt" class="input-xxlarge">
+        <input type="text" name="themes" placeholder="themes, comma separated">
+        <button type="submit" class="btn btn-primary">Add</button>
+    </form>
+</div>
+{{end}}`
+
+// PromptContent is a single row of the prompt library. Key is empty for
+// built-in prompts, which can't be deleted.
+type PromptContent struct {
+	Text   string
+	Themes string
+	Key    string
+}
+
+type PromptsContent struct {
+	Window  int
+	Themes  string
+	Prompts []PromptContent
+}
+
+const navigationTemplateHTML = `{{define "navigation"}}
+<div class="navigation">
+    <ul class="nav nav-pills">
+        {{range .Years}}<li{{if .Active}} class="active"{{end}}><a href="{{.URL}}">{{.Label}}</a></li>{{end}}
+    </ul>
+    <ul class="nav nav-pills">
+        {{range .Months}}<li{{if .Active}} class="active"{{end}}><a href="{{.URL}}">{{.Label}}</a></li>{{end}}
+    </ul>
+    <form action="/" method="get" class="form-inline">
+        <input type="date" name="from" value="{{.From}}" class="input-medium">
+        to
+        <input type="date" name="to" value="{{.To}}" class="input-medium">
+        <button type="submit" class="btn">Show</button>
+        <a href="/" class="btn">All entries</a>
+    </form>
+</div>
+{{end}}`
+
+const paginationTemplateHTML = `{{define "pagination"}}
+<ul class="pager">
+    {{if .Newest}}<li class="previous"><a href="{{.Newest}}">&larr; Newest</a></li>{{end}}
+    {{if .Older}}<li class="next"><a href="{{.Older}}">Older &rarr;</a></li>{{end}}
+</ul>
+{{end}}`
+
+type NavigationLink struct {
+	Label  string
+	URL    string
+	Active bool
+}
+
+type NavigationContent struct {
+	Years  []NavigationLink
+	Months []NavigationLink
+	From   string
+	To     string
+	Older  string
+	Newest string
+}
+
+// newPage parses a page body together with the base layout and all partials.
+func newPage(body string) *template.Template {
+	t := template.New("base")
+	for _, partial := range []string{
+		baseTemplateHTML,
+		entryTemplateHTML,
+		richTextTemplateHTML,
+		sectionsTemplateHTML,
+		attachmentTemplateHTML,
+		navigationTemplateHTML,
+		paginationTemplateHTML,
+		body,
+	} {
+		template.Must(t.Parse(partial))
+	}
+	return t
+}
+
+// renderPage writes a complete page rendered from one of the page templates.
+func renderPage(c appengine.Context, w http.ResponseWriter, t *template.Template, title string, body interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := t.ExecuteTemplate(w, "base", BodyContent{
+		Body:  body,
+		Title: title,
+	})
+	if err != nil {
+		c.Errorf("failed to render page '%v': %v", title, err)
+	}
 }
 
-var baseTemplate = template.Must(template.New("body").Parse(baseTemplateHTML))
-var entryTemplate = template.Must(template.New("entry").Parse(entryTemplateHTML))
-var entryAppendTemplate = template.Must(template.New("entryAppend").Parse(entryAppendTemplateHTML))
-var attachmentTemplate = template.Must(template.New("attachment").Parse(attachmentTemplateHTML))
+var entriesTemplate = newPage(entriesTemplateHTML)
+var entryAppendTemplate = newPage(entryAppendTemplateHTML)
+var entryPageTemplate = newPage(entryPageTemplateHTML)
+var entryEditTemplate = newPage(entryEditTemplateHTML)
+var historyTemplate = newPage(historyTemplateHTML)
+var newEntryTemplate = newPage(newEntryTemplateHTML)
+var moveTemplate = newPage(moveTemplateHTML)
+var searchTemplate = newPage(searchTemplateHTML)
+var tagsTemplate = newPage(tagsTemplateHTML)
+var tagTemplate = newPage(tagTemplateHTML)
+var ideaBoardTemplate = newPage(ideaBoardTemplateHTML)
+var ideaTemplate = newPage(ideaTemplateHTML)
+var todosTemplate = newPage(todosTemplateHTML)
+var peopleTemplate = newPage(peopleTemplateHTML)
+var personTemplate = newPage(personTemplateHTML)
+var moodTemplate = newPage(moodTemplateHTML)
+var fieldsTemplate = newPage(fieldsTemplateHTML)
+var statsTemplate = newPage(statsTemplateHTML)
+var calendarTemplate = newPage(calendarTemplateHTML)
+var galleryTemplate = newPage(galleryTemplateHTML)
+var trashTemplate = newPage(trashTemplateHTML)
+var promptsTemplate = newPage(promptsTemplateHTML)
+var reminderSettingsTemplate = newPage(reminderSettingsTemplateHTML)
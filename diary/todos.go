@@ -0,0 +1,220 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Todo is a checkbox item of an entry, like "- [ ] call the bank". Todos are
+// derived from the content like the search index and stored as children of
+// their entry, with the position of the checkbox in the entry as id. Ticking
+// one off changes the entry, so the two never disagree.
+type Todo struct {
+	// not indexed, as a long line would exceed the limit for indexed strings
+	Text string `datastore:",noindex"`
+	Done bool
+	// of the entry, to list todos without fetching their entries
+	Date time.Time
+}
+
+// the same checkbox list items parseMarkdown renders
+var todoRegexp = regexp.MustCompile(`^(\s{0,3}[-*+]\s+\[)([ xX])(\]\s+)(.*)$`)
+
+func extractTodos(content []byte, date time.Time) []Todo {
+	todos := []Todo{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if m := todoRegexp.FindStringSubmatch(line); m != nil {
+			todos = append(todos, Todo{
+				Text: strings.TrimSpace(m[4]),
+				Done: m[2] != " ",
+				Date: date,
+			})
+		}
+	}
+	return todos
+}
+
+// putTodos replaces the todos of an entry.
+func putTodos(c appengine.Context, entryKey *datastore.Key, todos []Todo) error {
+	if err := deleteTodos(c, entryKey); err != nil {
+		return err
+	}
+	if len(todos) == 0 {
+		return nil
+	}
+
+	keys := []*datastore.Key{}
+	for i := range todos {
+		keys = append(keys, datastore.NewKey(c, "Todo", "", int64(i+1), entryKey))
+	}
+	if _, err := datastore.PutMulti(c, keys, todos); err != nil {
+		return fmt.Errorf("failed to save todos: %v", err)
+	}
+	return nil
+}
+
+func deleteTodos(c appengine.Context, entryKey *datastore.Key) error {
+	keys, err := datastore.NewQuery("Todo").Ancestor(entryKey).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return fmt.Errorf("failed to fetch todos: %v", err)
+	}
+	if err = datastore.DeleteMulti(c, keys); err != nil {
+		return fmt.Errorf("failed to delete todos: %v", err)
+	}
+	return nil
+}
+
+// loadTodos returns open or done todos, newest first.
+func loadTodos(c appengine.Context, done bool, limit int) ([]*datastore.Key, []Todo, error) {
+	var todos []Todo
+	q := datastore.NewQuery("Todo").Filter("Done =", done).Order("-Date")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	keys, err := q.GetAll(c, &todos)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load todos: %v", err)
+	}
+	return keys, todos, nil
+}
+
+// openTodoTexts lists the open todos for the reminder, oldest first.
+func openTodoTexts(c appengine.Context) ([]string, error) {
+	_, todos, err := loadTodos(c, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	texts := []string{}
+	for i := len(todos) - 1; i >= 0; i-- {
+		texts = append(texts, todos[i].Text)
+	}
+	return texts, nil
+}
+
+// number of done todos shown below the open ones
+const doneTodosShown = 20
+
+func showTodos(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	content := TodosContent{}
+	for _, done := range []bool{false, true} {
+		limit := 0
+		if done {
+			limit = doneTodosShown
+		}
+		keys, todos, err := loadTodos(c, done, limit)
+		if err != nil {
+			c.Errorf("%v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		list := []TodoContent{}
+		for i, t := range todos {
+			list = append(list, TodoContent{
+				Key:  keys[i].Encode(),
+				Text: t.Text,
+				Done: t.Done,
+				Date: t.Date.In(loc),
+				Day:  t.Date.In(loc).Format(dateFormat),
+			})
+		}
+		if done {
+			content.Done = list
+		} else {
+			content.Open = list
+		}
+	}
+
+	renderPage(c, w, todosTemplate, "Todos", content)
+}
+
+// toggleTodo ticks a todo off, or on again, by changing the checkbox in its
+// entry.
+func toggleTodo(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	rawKey := r.FormValue("key")
+	key, err := datastore.DecodeKey(rawKey)
+	if err != nil || key.Kind() != "Todo" || key.Parent() == nil {
+		c.Errorf("Failed to parse decode key '%v': %v", rawKey, err)
+		http.Error(w, "invalid todo", http.StatusBadRequest)
+		return
+	}
+	done := r.FormValue("done") != ""
+
+	mark := " "
+	if done {
+		mark = "x"
+	}
+
+	var e DiaryEntry
+	_, err = saveEntry(c, key.Parent(), &e, sourceWeb, func(e *DiaryEntry) error {
+		if setTodo(e.Sections, int(key.IntID()), r.FormValue("text"), mark) {
+			return nil
+		}
+		// sections of legacy entries are only split on the fly
+		e.Sections = entrySections(*e)
+		if !setTodo(e.Sections, int(key.IntID()), r.FormValue("text"), mark) {
+			return errEntryChanged
+		}
+		return nil
+	})
+	if err == errEntryChanged {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/todos")
+	w.WriteHeader(http.StatusFound)
+}
+
+// setTodo sets the checkbox of the nth todo in sections, counting from 1, if
+// it still has the given text.
+func setTodo(sections []Section, n int, text, mark string) bool {
+	count := 0
+	for i, s := range sections {
+		lines := strings.Split(string(s.Text), "\n")
+		for j, line := range lines {
+			m := todoRegexp.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			count++
+			if count != n {
+				continue
+			}
+			if strings.TrimSpace(m[4]) != text {
+				return false
+			}
+			lines[j] = m[1] + mark + m[3] + m[4]
+			sections[i].Text = []byte(strings.Join(lines, "\n"))
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,371 @@
+package diary
+
+import (
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+	"appengine/image"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Deleted entries and attachments are moved into the trash, which keeps their
+// original key so they can be put back unchanged. Revisions stay children of
+// the original entry key and are only removed when the entry is purged.
+
+type TrashedEntry struct {
+	Entry        DiaryEntry
+	OriginalKey  *datastore.Key
+	DeletionTime time.Time
+}
+
+type TrashedAttachment struct {
+	Attachment  Attachment
+	OriginalKey *datastore.Key
+	// the entry the attachment was removed from
+	EntryKey     *datastore.Key
+	DeletionTime time.Time
+}
+
+var xg = &datastore.TransactionOptions{XG: true}
+
+func trashEntry(c appengine.Context, key *datastore.Key) error {
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var e DiaryEntry
+		if err := datastore.Get(c, key, &e); err != nil {
+			return fmt.Errorf("failed to fetch entry: %v", err)
+		}
+		return putInTrash(c, key, e)
+	}, xg)
+}
+
+// putInTrash moves an entry as given to the trash, in the caller's
+// transaction.
+func putInTrash(c appengine.Context, key *datastore.Key, e DiaryEntry) error {
+	t := TrashedEntry{
+		Entry:        e,
+		OriginalKey:  key,
+		DeletionTime: time.Now(),
+	}
+	if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "TrashedEntry", nil), &t); err != nil {
+		return fmt.Errorf("failed to move entry to trash: %v", err)
+	}
+	return removeEntry(c, key)
+}
+
+// trashAttachment removes an attachment from its entry and moves it to the trash.
+func trashAttachment(c appengine.Context, entryKey, key *datastore.Key) error {
+	settings, err := loadEntrySettings(c)
+	if err != nil {
+		return err
+	}
+
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var e DiaryEntry
+		var a Attachment
+		err := datastore.GetMulti(c, []*datastore.Key{entryKey, key}, []interface{}{&e, &a})
+		if err != nil {
+			return fmt.Errorf("failed to fetch attachment: %v", err)
+		}
+
+		e.Attachments = removeKey(e.Attachments, key)
+		if _, err = putEntry(c, entryKey, &e, settings); err != nil {
+			return fmt.Errorf("failed to save entry: %v", err)
+		}
+
+		t := TrashedAttachment{
+			Attachment:   a,
+			OriginalKey:  key,
+			EntryKey:     entryKey,
+			DeletionTime: time.Now(),
+		}
+		if _, err = datastore.Put(c, datastore.NewIncompleteKey(c, "TrashedAttachment", nil), &t); err != nil {
+			return fmt.Errorf("failed to move attachment to trash: %v", err)
+		}
+		return datastore.Delete(c, key)
+	}, xg)
+}
+
+func restoreFromTrash(c appengine.Context, trashKey *datastore.Key) error {
+	settings, err := loadEntrySettings(c)
+	if err != nil {
+		return err
+	}
+
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		switch trashKey.Kind() {
+		case "TrashedEntry":
+			var t TrashedEntry
+			if err := datastore.Get(c, trashKey, &t); err != nil {
+				return fmt.Errorf("failed to fetch trashed entry: %v", err)
+			}
+			if _, err := putEntry(c, t.OriginalKey, &t.Entry, settings); err != nil {
+				return fmt.Errorf("failed to restore entry: %v", err)
+			}
+
+		case "TrashedAttachment":
+			var t TrashedAttachment
+			if err := datastore.Get(c, trashKey, &t); err != nil {
+				return fmt.Errorf("failed to fetch trashed attachment: %v", err)
+			}
+			var e DiaryEntry
+			if err := datastore.Get(c, t.EntryKey, &e); err != nil {
+				return fmt.Errorf("the entry of this attachment is gone, restore it first: %v", err)
+			}
+			e.Attachments = append(e.Attachments, t.OriginalKey)
+			if _, err := putEntry(c, t.EntryKey, &e, settings); err != nil {
+				return fmt.Errorf("failed to save entry: %v", err)
+			}
+			if _, err := datastore.Put(c, t.OriginalKey, &t.Attachment); err != nil {
+				return fmt.Errorf("failed to restore attachment: %v", err)
+			}
+
+		default:
+			return fmt.Errorf("not in the trash: %v", trashKey)
+		}
+		return datastore.Delete(c, trashKey)
+	}, xg)
+}
+
+// purgeFromTrash deletes a trashed entry or attachment for good, including
+// blobs, serving URLs and revisions.
+func purgeFromTrash(c appengine.Context, trashKey *datastore.Key) error {
+	switch trashKey.Kind() {
+	case "TrashedEntry":
+		var t TrashedEntry
+		if err := datastore.Get(c, trashKey, &t); err != nil {
+			return fmt.Errorf("failed to fetch trashed entry: %v", err)
+		}
+
+		attachments := make([]Attachment, len(t.Entry.Attachments))
+		err := datastore.GetMulti(c, t.Entry.Attachments, attachments)
+		errs, partial := err.(appengine.MultiError)
+		if err != nil && !partial {
+			return fmt.Errorf("failed to fetch attachments: %v", err)
+		}
+		for i, a := range attachments {
+			if partial && errs[i] != nil {
+				// already gone
+				continue
+			}
+			if err = deleteBlob(c, a); err != nil {
+				return err
+			}
+		}
+		if err = datastore.DeleteMulti(c, t.Entry.Attachments); err != nil {
+			return fmt.Errorf("failed to delete attachments: %v", err)
+		}
+
+		revisions, err := datastore.NewQuery("Revision").Ancestor(t.OriginalKey).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return fmt.Errorf("failed to fetch revisions: %v", err)
+		}
+		if err = datastore.DeleteMulti(c, revisions); err != nil {
+			return fmt.Errorf("failed to delete revisions: %v", err)
+		}
+
+	case "TrashedAttachment":
+		var t TrashedAttachment
+		if err := datastore.Get(c, trashKey, &t); err != nil {
+			return fmt.Errorf("failed to fetch trashed attachment: %v", err)
+		}
+		if err := deleteBlob(c, t.Attachment); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("not in the trash: %v", trashKey)
+	}
+
+	if err := datastore.Delete(c, trashKey); err != nil {
+		return fmt.Errorf("failed to delete from trash: %v", err)
+	}
+	return nil
+}
+
+// deleteBlob removes the content of an attachment and its serving URLs.
+func deleteBlob(c appengine.Context, a Attachment) error {
+	if a.Thumbnail != "" || a.BigImage != "" {
+		// both serving URLs belong to the same blob and go away together
+		if err := image.DeleteServingURL(c, a.Content); err != nil {
+			return fmt.Errorf("failed to delete serving url of '%v': %v", a.Name, err)
+		}
+	}
+	if err := blobstore.Delete(c, a.Content); err != nil {
+		return fmt.Errorf("failed to delete blob of '%v': %v", a.Name, err)
+	}
+	return nil
+}
+
+func removeKey(keys []*datastore.Key, key *datastore.Key) []*datastore.Key {
+	kept := []*datastore.Key{}
+	for _, k := range keys {
+		if !k.Equal(key) {
+			kept = append(kept, k)
+		}
+	}
+	return kept
+}
+
+func deleteEntry(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	key := decodeEntryKey(c, w, r)
+	if key == nil {
+		return
+	}
+
+	if err := trashEntry(c, key); err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/trash")
+	w.WriteHeader(http.StatusFound)
+}
+
+func deleteAttachment(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	key := decodeEntryKey(c, w, r)
+	if key == nil {
+		return
+	}
+
+	rawAttachment := r.FormValue("attachment")
+	attachmentKey, err := datastore.DecodeKey(rawAttachment)
+	if err != nil || attachmentKey.Kind() != "Attachment" {
+		c.Errorf("Failed to parse decode key '%v': %v", rawAttachment, err)
+		http.Error(w, "invalid attachment", http.StatusBadRequest)
+		return
+	}
+
+	if err = trashAttachment(c, key, attachmentKey); err != nil {
+		c.Errorf("%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/edit?key="+url.QueryEscape(key.Encode()))
+	w.WriteHeader(http.StatusFound)
+}
+
+func showTrash(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	loc, err := time.LoadLocation(diaryTimezone)
+	if err != nil {
+		c.Errorf("Failed to load timezone")
+		return
+	}
+
+	var entries []TrashedEntry
+	entryKeys, err := datastore.NewQuery("TrashedEntry").Order("-DeletionTime").GetAll(c, &entries)
+	if err != nil {
+		c.Errorf("failed to load trashed entries: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var attachments []TrashedAttachment
+	attachmentKeys, err := datastore.NewQuery("TrashedAttachment").Order("-DeletionTime").GetAll(c, &attachments)
+	if err != nil {
+		c.Errorf("failed to load trashed attachments: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	content := TrashContent{
+		Entries:     []TrashedEntryContent{},
+		Attachments: []TrashedAttachmentContent{},
+	}
+	for i, t := range entries {
+		content.Entries = append(content.Entries, TrashedEntryContent{
+			Key:          entryKeys[i].Encode(),
+			Date:         t.Entry.Date.In(loc),
+			DeletionTime: t.DeletionTime.In(loc),
+			Sections:     newSectionContents(t.Entry, loc),
+			Attachments:  len(t.Entry.Attachments),
+		})
+	}
+	for i, t := range attachments {
+		content.Attachments = append(content.Attachments, TrashedAttachmentContent{
+			Key:          attachmentKeys[i].Encode(),
+			Name:         t.Attachment.Name,
+			Thumbnail:    t.Attachment.Thumbnail,
+			DeletionTime: t.DeletionTime.In(loc),
+		})
+	}
+
+	renderPage(c, w, trashTemplate, "Trash", content)
+}
+
+// trashAction handles the restore and purge buttons of the trash page.
+func trashAction(action func(appengine.Context, *datastore.Key) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+
+		if !ensureAdmin(c, w, r) {
+			return
+		}
+
+		rawKey := r.FormValue("key")
+		key, err := datastore.DecodeKey(rawKey)
+		if err != nil {
+			c.Errorf("Failed to parse decode key '%v': %v", rawKey, err)
+			http.Error(w, "invalid key", http.StatusBadRequest)
+			return
+		}
+
+		if err = action(c, key); err != nil {
+			c.Errorf("%v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Location", "/trash")
+		w.WriteHeader(http.StatusFound)
+	}
+}
+
+func emptyTrash(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !ensureAdmin(c, w, r) {
+		return
+	}
+
+	for _, kind := range []string{"TrashedAttachment", "TrashedEntry"} {
+		keys, err := datastore.NewQuery(kind).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			c.Errorf("failed to load trash: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, key := range keys {
+			if err = purgeFromTrash(c, key); err != nil {
+				c.Errorf("%v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Location", "/trash")
+	w.WriteHeader(http.StatusFound)
+}
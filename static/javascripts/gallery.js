@@ -0,0 +1,30 @@
+// Opens the big version of a gallery photo on top of the page, with a link to
+// its entry. Clicking the photo or pressing escape closes it again.
+$(function() {
+  var lightbox = $('.lightbox');
+
+  function close() {
+    lightbox.hide();
+    lightbox.find('img').attr('src', '');
+  }
+
+  $('.gallery-photo').on('click', function(e) {
+    e.preventDefault();
+    var photo = $(this);
+    lightbox.find('img').attr('src', photo.attr('href')).attr('alt', photo.attr('title'));
+    lightbox.find('.lightbox-name').text(photo.attr('title'));
+    lightbox.find('.lightbox-entry').attr('href', photo.data('entry'));
+    lightbox.show();
+  });
+
+  lightbox.on('click', function(e) {
+    if (!$(e.target).is('a')) {
+      close();
+    }
+  });
+  $(document).on('keyup', function(e) {
+    if (e.which == 27) {
+      close();
+    }
+  });
+});
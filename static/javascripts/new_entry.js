@@ -0,0 +1,49 @@
+// Drag and drop for attachments and autosaving of drafts on the new entry page.
+$(function() {
+  var form = $('#new-entry');
+  var input = form.find('input[type=file]');
+  var dropzone = form.find('.dropzone');
+  var status = form.find('.draft-status');
+
+  function listFiles() {
+    var list = form.find('.dropped-files').empty();
+    $.each(input[0].files, function(i, file) {
+      list.append($('<li>').text(file.name));
+    });
+  }
+
+  dropzone.on('dragover', function(e) {
+    e.preventDefault();
+    dropzone.addClass('dragging');
+  });
+  dropzone.on('dragleave', function() {
+    dropzone.removeClass('dragging');
+  });
+  dropzone.on('drop', function(e) {
+    e.preventDefault();
+    dropzone.removeClass('dragging');
+    input[0].files = e.originalEvent.dataTransfer.files;
+    listFiles();
+  });
+  input.on('change', listFiles);
+
+  var timer = null;
+  function saveDraft() {
+    $.post('/drafts/save', {
+      date: form.find('input[name=date]').val(),
+      content: form.find('textarea[name=content]').val()
+    }).done(function() {
+      status.text('Draft saved at ' + new Date().toLocaleTimeString());
+    }).fail(function() {
+      status.text('Failed to save draft');
+    });
+  }
+
+  form.find('input[name=date], textarea[name=content]').on('input change', function() {
+    clearTimeout(timer);
+    timer = setTimeout(saveDraft, 2000);
+  });
+  form.on('submit', function() {
+    clearTimeout(timer);
+  });
+});